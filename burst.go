@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+)
+
+// A run of consecutive lost requests.
+type lossBurst struct {
+	FirstSeq      uint16
+	LastSeq       uint16
+	Length        uint64
+	FirstSendTime time.Time
+	LastSendTime  time.Time
+	Interval      time.Duration
+}
+
+// Protected by destinationState.mtx.
+type burstState struct {
+	Current     *lossBurst
+	HasLastSent bool
+	LastSent    uint16
+}
+
+// Remember the latest request sent, so we can tell whether the request following a burst is still pending.
+// The caller must hold destinationState.mtx.
+func (b *burstState) sent(seq uint16) {
+	b.HasLastSent = true
+	b.LastSent = seq
+}
+
+// Extend the current burst with a lost request, or start a new one.
+// If the lost request is not adjacent to the current burst, the current burst has ended and is returned.
+// The burst also ends if the request following it has already been sent and is no longer in flight:
+// its reply usually arrives long before the timeout of the lost request expires.
+// The caller must hold destinationState.mtx.
+func (b *burstState) addLost(seq uint16, sendTime time.Time, interval time.Duration, inFlight map[uint16]inFlightRequest) (ended []*lossBurst) {
+	if cur := b.Current; cur != nil {
+		switch seq {
+		case cur.LastSeq + 1:
+			cur.LastSeq = seq
+			cur.LastSendTime = sendTime
+			cur.Length++
+		case cur.FirstSeq - 1:
+			// Timers of adjacent requests may fire in the reverse order.
+			cur.FirstSeq = seq
+			cur.FirstSendTime = sendTime
+			cur.Length++
+		default:
+			ended = append(ended, cur)
+			b.Current = nil
+		}
+	}
+	if b.Current == nil {
+		b.Current = &lossBurst{
+			FirstSeq:      seq,
+			LastSeq:       seq,
+			Length:        1,
+			FirstSendTime: sendTime,
+			LastSendTime:  sendTime,
+			Interval:      interval,
+		}
+	}
+	next := b.Current.LastSeq + 1
+	if _, pending := inFlight[next]; !pending && b.HasLastSent && int16(b.LastSent-next) >= 0 {
+		ended = append(ended, b.Current)
+		b.Current = nil
+	}
+	return
+}
+
+// End the current burst if the request following it is not lost.
+// The caller must hold destinationState.mtx.
+func (b *burstState) interrupt(seq uint16) (ended *lossBurst) {
+	if cur := b.Current; cur != nil && seq == cur.LastSeq+1 {
+		ended = cur
+		b.Current = nil
+	}
+	return
+}
+
+func (app *appState) printLossBurst(dest *destinationState, burst *lossBurst) {
+	app.recordLossBurst(dest, burst)
+	p := &point{Measurement: "ping_loss_burst", Time: burst.FirstSendTime}
+	p.AddDestinationTags(dest.Params)
+	if dest.Params.IsEcho() {
+		p.AddField("icmp_id", uint64(dest.ID))
+		p.AddField("first_icmp_seq", uint64(burst.FirstSeq))
+	}
+	p.AddField("length", burst.Length)
+	p.AddField("duration", burst.LastSendTime.Sub(burst.FirstSendTime)+burst.Interval)
+	app.writePoint(p)
+}
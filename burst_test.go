@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBurstEndsWhenNextRequestAlreadyReplied(t *testing.T) {
+	// With -W longer than -i, the reply to seq 11 arrives before the timer of seq 10 fires.
+	var b burstState
+	inFlight := map[uint16]inFlightRequest{}
+	for seq := uint16(10); seq <= 12; seq++ {
+		b.sent(seq)
+		inFlight[seq] = inFlightRequest{}
+	}
+	delete(inFlight, 11)
+	if ended := b.interrupt(11); ended != nil {
+		t.Fatalf("interrupt(11) ended a burst before any loss: %+v", ended)
+	}
+	delete(inFlight, 10)
+	ended := b.addLost(10, time.Time{}, time.Second, inFlight)
+	if len(ended) != 1 || ended[0].FirstSeq != 10 || ended[0].Length != 1 {
+		t.Fatalf("addLost(10) = %+v, want a single burst of seq 10", ended)
+	}
+	if b.Current != nil {
+		t.Fatalf("burst still open: %+v", b.Current)
+	}
+}
+
+func TestBurstAddLost(t *testing.T) {
+	tests := []struct {
+		name     string
+		lastSent uint16
+		inFlight []uint16
+		// Lost in this order, in flight until then.
+		lost []uint16
+		// Lengths of the bursts ended by the last loss, and of the burst left open.
+		ended   []uint64
+		current uint64
+	}{
+		{"next pending", 3, []uint16{3}, []uint16{1, 2}, nil, 2},
+		{"next not sent yet", 2, nil, []uint16{1, 2}, nil, 2},
+		{"next replied", 3, nil, []uint16{1, 2}, []uint64{2}, 0},
+		{"reverse order", 3, []uint16{3}, []uint16{2, 1}, nil, 2},
+		{"not adjacent", 9, []uint16{2, 6}, []uint16{1, 5}, []uint64{1}, 1},
+		{"not adjacent and next replied", 9, []uint16{2}, []uint16{1, 5}, []uint64{1, 1}, 0},
+		{"wraparound", 1, []uint16{1}, []uint16{65535, 0}, nil, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := burstState{HasLastSent: true, LastSent: tt.lastSent}
+			inFlight := map[uint16]inFlightRequest{}
+			for _, seq := range append(tt.inFlight, tt.lost...) {
+				inFlight[seq] = inFlightRequest{}
+			}
+			var ended []*lossBurst
+			for _, seq := range tt.lost {
+				delete(inFlight, seq)
+				ended = b.addLost(seq, time.Time{}, time.Second, inFlight)
+			}
+			if len(ended) != len(tt.ended) {
+				t.Fatalf("ended %d bursts, want %d", len(ended), len(tt.ended))
+			}
+			for i, burst := range ended {
+				if burst.Length != tt.ended[i] {
+					t.Errorf("ended[%d].Length = %d, want %d", i, burst.Length, tt.ended[i])
+				}
+			}
+			var current uint64
+			if b.Current != nil {
+				current = b.Current.Length
+			}
+			if current != tt.current {
+				t.Errorf("current length = %d, want %d", current, tt.current)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// An ICMP error answering one of our requests.
+type icmpError struct {
+	Name string
+	From net.Addr
+}
+
+// An ICMP error read from the socket error queue, see readErrQueue.
+type sockError struct {
+	Type     icmp.Type
+	Code     int
+	Offender net.IP
+	// The quoted payload of the transport layer, i.e., the ICMP header for ICMP sockets, or the UDP payload for UDP sockets.
+	Payload []byte
+}
+
+var icmpCodeNames = map[icmp.Type][]string{
+	ipv4.ICMPTypeDestinationUnreachable: {
+		"net unreachable",
+		"host unreachable",
+		"protocol unreachable",
+		"port unreachable",
+		"fragmentation needed",
+		"source route failed",
+		"destination network unknown",
+		"destination host unknown",
+		"source host isolated",
+		"network administratively prohibited",
+		"host administratively prohibited",
+		"network unreachable for TOS",
+		"host unreachable for TOS",
+		"communication administratively prohibited",
+		"host precedence violation",
+		"precedence cutoff in effect",
+	},
+	ipv4.ICMPTypeTimeExceeded: {
+		"TTL exceeded in transit",
+		"fragment reassembly time exceeded",
+	},
+	ipv6.ICMPTypeDestinationUnreachable: {
+		"no route to destination",
+		"communication administratively prohibited",
+		"beyond scope of source address",
+		"address unreachable",
+		"port unreachable",
+		"source address failed ingress/egress policy",
+		"reject route to destination",
+		"error in source routing header",
+	},
+	ipv6.ICMPTypeTimeExceeded: {
+		"hop limit exceeded in transit",
+		"fragment reassembly time exceeded",
+	},
+}
+
+// Name an ICMP error by its type and code, e.g., "destination unreachable: port unreachable".
+func icmpErrorName(typ icmp.Type, code int) string {
+	if typ == ipv6.ICMPTypePacketTooBig {
+		return fmt.Sprint(typ)
+	}
+	if names := icmpCodeNames[typ]; code >= 0 && code < len(names) {
+		return fmt.Sprintf("%v: %s", typ, names[code])
+	}
+	return fmt.Sprintf("%v: code %d", typ, code)
+}
+
+// Match an ICMP error against our ICMP echo or timestamp requests by the request it quotes.
+// The request is then reported as lost, with the error.
+func (app *appState) processProbeError(isIPv6 bool, src net.Addr, recvTime time.Time, typ icmp.Type, code int, quoted []byte) {
+	proto, _, transport, ok := parseQuotedPacket(isIPv6, quoted)
+	if !ok {
+		return
+	}
+	var probe string
+	switch {
+	case isIPv6 && proto == 58 && transport[0] == byte(ipv6.ICMPTypeEchoRequest), !isIPv6 && proto == 1 && transport[0] == byte(ipv4.ICMPTypeEcho):
+		probe = "icmp"
+	case !isIPv6 && proto == 1 && transport[0] == byte(ipv4.ICMPTypeTimestamp):
+		probe = "timestamp"
+	default:
+		return
+	}
+	id := binary.BigEndian.Uint16(transport[4:6])
+	seq := binary.BigEndian.Uint16(transport[6:8])
+	for i := range app.Destinations {
+		dest := &app.Destinations[i]
+		if dest.Params.Probe != probe || dest.ID != id {
+			continue
+		}
+		if series := app.errorSeriesOf(dest, src); series != nil {
+			app.failRequest(series, seq, recvTime, &icmpError{
+				Name: icmpErrorName(typ, code),
+				From: src,
+			})
+		}
+	}
+}
+
+// Handle a failed read from the send socket of dest.
+// If the failure is caused by ICMP errors queued on the socket, report them and return true.
+func (app *appState) processSocketErrors(dest *destinationState, conn syscall.Conn, readErr error) bool {
+	var errno syscall.Errno
+	if !errors.As(readErr, &errno) {
+		return false
+	}
+	n, _, err := app.drainErrQueue(dest, conn)
+	if err != nil {
+		return false
+	}
+	if n != 0 {
+		return true
+	}
+	// The ICMP error may have been drained by collectTxTimestamps already.
+	dest.mtx.Lock()
+	defer dest.mtx.Unlock()
+	if dest.drainedErrors == 0 {
+		return false
+	}
+	dest.drainedErrors--
+	return true
+}
+
+// Report the ICMP errors on the socket error queue of a send socket of dest,
+// and record the transmit timestamps read along with them.
+// Return the number of messages read from the queue, and how many of them are ICMP errors.
+func (app *appState) drainErrQueue(dest *destinationState, conn syscall.Conn) (n, icmpErrors int, err error) {
+	errs, stamps, n, err := readErrQueue(conn)
+	now := time.Now()
+	app.recordTxTimestamps(dest, now, stamps)
+	for i := range errs {
+		app.processSocketError(dest, app.nextUnixTime(now), &errs[i])
+	}
+	return n, len(errs), err
+}
+
+func (app *appState) processSocketError(dest *destinationState, recvTime time.Time, sockErr *sockError) {
+	var id, seq uint16
+	switch dest.Params.Probe {
+	case "icmp":
+		// The identifier has been overwritten by the kernel, so it is the same as dest.ID.
+		if len(sockErr.Payload) < 8 {
+			return
+		}
+		id = binary.BigEndian.Uint16(sockErr.Payload[4:6])
+		seq = binary.BigEndian.Uint16(sockErr.Payload[6:8])
+	case "udp":
+		body, ok := parseUDPEcho(sockErr.Payload)
+		if !ok {
+			return
+		}
+		id, seq = uint16(body.ID), uint16(body.Seq)
+	case "stamp":
+		if len(sockErr.Payload) < 4 {
+			return
+		}
+		id, seq = dest.ID, uint16(binary.BigEndian.Uint32(sockErr.Payload[0:4]))
+	default:
+		return
+	}
+	if id != dest.ID {
+		return
+	}
+	var from net.Addr
+	if sockErr.Offender != nil {
+		from = &net.IPAddr{IP: sockErr.Offender}
+	}
+	series := app.errorSeriesOf(dest, from)
+	if series == nil {
+		return
+	}
+	app.failRequest(series, seq, recvTime, &icmpError{
+		Name: icmpErrorName(sockErr.Type, sockErr.Code),
+		From: from,
+	})
+}
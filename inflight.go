@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+)
+
+type inFlightRequest struct {
+	Gen      uint64
+	SendTime time.Time
+	// When the request actually left, if its transmit timestamp has been read.
+	TxTime      time.Time
+	TxTimestamp string
+}
+
+type lostRequest struct {
+	// The ICMP error answering the request, if any.
+	Error    *icmpError
+	ID       uint16
+	LostTime time.Time
+	Params   *params.DestinationParams
+	Seq      uint16
+}
+
+// Start waiting for the reply of a request.
+// If no reply arrives within the timeout, a loss record is printed.
+// Must be called before the request is sent, otherwise a quick reply may arrive before we start waiting.
+func (app *appState) trackRequest(dest *destinationState, seq uint16) {
+	if dest.Params.Multicast != 0 {
+		// Each responder waits for its own reply. New responders start waiting when their first reply arrives.
+		app.expireResponders(dest)
+		for _, r := range app.seriesOf(dest) {
+			app.trackRequest(r, seq)
+		}
+		return
+	}
+	dest.mtx.Lock()
+	if old, ok := dest.inFlight[seq]; ok {
+		// The sequence number wrapped around before the previous request timed out.
+		delete(dest.inFlight, seq)
+		ended := dest.burst.addLost(seq, old.SendTime, dest.Params.Interval, dest.inFlight)
+		dest.mtx.Unlock()
+		app.reportLost(dest, seq, app.nextUnixTime(time.Now()), nil, ended)
+		dest.mtx.Lock()
+	}
+	dest.burst.sent(seq)
+	dest.nextGen++
+	gen := dest.nextGen
+	dest.inFlight[seq] = inFlightRequest{
+		Gen:      gen,
+		SendTime: time.Now(),
+	}
+	dest.arrival.sent(seq)
+	dest.mtx.Unlock()
+
+	time.AfterFunc(dest.Params.Timeout, func() {
+		dest.mtx.Lock()
+		req, ok := dest.inFlight[seq]
+		if !ok || req.Gen != gen {
+			dest.mtx.Unlock()
+			return
+		}
+		delete(dest.inFlight, seq)
+		ended := dest.burst.addLost(seq, req.SendTime, dest.Params.Interval, dest.inFlight)
+		dest.mtx.Unlock()
+		app.reportLost(dest, seq, app.nextUnixTime(time.Now()), nil, ended)
+	})
+}
+
+// Return how long a probe using a connection, e.g., TCP, HTTP, or DNS, waits for the reply before giving up.
+// It leaves some room for the in-flight timer to report the loss first, so the probe itself never reports a timeout.
+func probeTimeout(dest *destinationState) time.Duration {
+	return dest.Params.Timeout + time.Second
+}
+
+// Log why a probe using a connection failed, unless it timed out.
+// Either way, the request is left in flight, so it is reported as lost after the timeout.
+func logProbeError(dest *destinationState, err error) {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		log.Printf("failed to ping %s: %v\n", dest.Params.Destination, err)
+	}
+}
+
+// Stop waiting for a request that failed to be sent.
+func (app *appState) untrackRequest(dest *destinationState, seq uint16) {
+	if dest.Params.Multicast != 0 {
+		for _, r := range app.seriesOf(dest) {
+			app.untrackRequest(r, seq)
+		}
+		return
+	}
+	dest.mtx.Lock()
+	delete(dest.inFlight, seq)
+	ended := dest.burst.interrupt(seq)
+	dest.mtx.Unlock()
+	if ended != nil {
+		app.printLossBurst(dest, ended)
+	}
+}
+
+// Return when a request was sent, if it is still in flight.
+func (app *appState) requestSendTime(dest *destinationState, seq uint16) (sendTime time.Time, ok bool) {
+	dest.mtx.Lock()
+	req, ok := dest.inFlight[seq]
+	dest.mtx.Unlock()
+	return req.SendTime, ok
+}
+
+// Stop waiting for a request that was answered by an ICMP error, then report it as lost with the error.
+func (app *appState) failRequest(dest *destinationState, seq uint16, recvTime time.Time, icmpErr *icmpError) {
+	if dest.Params.Multicast != 0 {
+		for _, r := range app.seriesOf(dest) {
+			app.failRequest(r, seq, recvTime, icmpErr)
+		}
+		return
+	}
+	dest.mtx.Lock()
+	req, ok := dest.inFlight[seq]
+	if !ok {
+		dest.mtx.Unlock()
+		return
+	}
+	delete(dest.inFlight, seq)
+	ended := dest.burst.addLost(seq, req.SendTime, dest.Params.Interval, dest.inFlight)
+	dest.mtx.Unlock()
+	app.reportLost(dest, seq, recvTime, icmpErr, ended)
+}
+
+// Stop waiting for a request whose reply has arrived.
+// Return false if the reply is late, i.e. the request has already been reported as lost.
+func (app *appState) completeRequest(dest *destinationState, seq uint16) (onTime bool) {
+	dest.mtx.Lock()
+	_, onTime = dest.inFlight[seq]
+	delete(dest.inFlight, seq)
+	var ended *lossBurst
+	if onTime {
+		ended = dest.burst.interrupt(seq)
+	}
+	dest.mtx.Unlock()
+	if ended != nil {
+		app.printLossBurst(dest, ended)
+	}
+	return
+}
+
+func (app *appState) reportLost(dest *destinationState, seq uint16, lostTime time.Time, icmpErr *icmpError, ended []*lossBurst) {
+	app.recordLost(dest)
+	app.printLost(&lostRequest{
+		Error:    icmpErr,
+		ID:       dest.ID,
+		LostTime: lostTime,
+		Params:   dest.Params,
+		Seq:      seq,
+	})
+	for _, burst := range ended {
+		app.printLossBurst(dest, burst)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+)
+
+const (
+	influxDBBatchSize     = 1000
+	influxDBFlushInterval = time.Second
+	influxDBMaxQueue      = 100000
+	influxDBMinBackoff    = time.Second
+	influxDBMaxBackoff    = time.Minute
+)
+
+// Write lines to InfluxDB through the "/api/v2/write" HTTP API, which both InfluxDB v2 and v3 support.
+// Lines are queued in memory while the server is unreachable. If the queue is full, the oldest lines are dropped.
+type influxDBWriter struct {
+	client   *http.Client
+	token    string
+	writeURL string
+
+	mtx     sync.Mutex
+	queue   []string
+	dropped uint64
+	notify  chan struct{}
+}
+
+func newInfluxDBWriter(params *params.PingParams) (w *influxDBWriter, err error) {
+	u, err := url.Parse(params.InfluxURL)
+	if err != nil {
+		err = fmt.Errorf("invalid InfluxDB URL %q: %w", params.InfluxURL, err)
+		return
+	}
+	u = u.JoinPath("api/v2/write")
+	query := u.Query()
+	query.Set("bucket", params.InfluxBucket)
+	if len(params.InfluxOrg) != 0 {
+		query.Set("org", params.InfluxOrg)
+	}
+	// nextUnixTime only keeps timestamps unique in nanoseconds, a coarser precision may merge points.
+	query.Set("precision", "ns")
+	u.RawQuery = query.Encode()
+
+	w = &influxDBWriter{
+		client:   &http.Client{Timeout: 30 * time.Second},
+		token:    params.InfluxToken,
+		writeURL: u.String(),
+		notify:   make(chan struct{}, 1),
+	}
+	go w.run()
+	return
+}
+
+func (w *influxDBWriter) WriteLine(line string) {
+	w.mtx.Lock()
+	if len(w.queue) >= influxDBMaxQueue {
+		w.queue = w.queue[1:]
+		w.dropped++
+	}
+	w.queue = append(w.queue, line)
+	full := len(w.queue) >= influxDBBatchSize
+	w.mtx.Unlock()
+	if full {
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *influxDBWriter) run() {
+	ticker := time.NewTicker(influxDBFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.notify:
+		}
+		for {
+			batch, dropped := w.takeBatch()
+			if dropped != 0 {
+				log.Printf("InfluxDB write queue is full, dropped %d lines\n", dropped)
+			}
+			if len(batch) == 0 {
+				break
+			}
+			w.writeBatch(batch)
+			if len(batch) < influxDBBatchSize {
+				break
+			}
+		}
+	}
+}
+
+func (w *influxDBWriter) takeBatch() (batch []string, dropped uint64) {
+	w.mtx.Lock()
+	n := min(len(w.queue), influxDBBatchSize)
+	batch = w.queue[:n:n]
+	w.queue = w.queue[n:]
+	dropped = w.dropped
+	w.dropped = 0
+	w.mtx.Unlock()
+	return
+}
+
+// Retry with exponential backoff until the batch is either accepted or rejected by the server.
+func (w *influxDBWriter) writeBatch(batch []string) {
+	body := strings.Join(batch, "")
+	backoff := influxDBMinBackoff
+	for {
+		retryAfter, err := w.post(body)
+		if err == nil {
+			return
+		}
+		if retryAfter < 0 {
+			log.Printf("failed to write %d lines to InfluxDB, dropping them: %v\n", len(batch), err)
+			return
+		}
+		delay := max(backoff, retryAfter)
+		log.Printf("failed to write %d lines to InfluxDB, will retry in %.0f seconds: %v\n", len(batch), delay.Seconds(), err)
+		time.Sleep(delay)
+		backoff = min(backoff*2, influxDBMaxBackoff)
+	}
+}
+
+// If the error is permanent, return a negative retryAfter.
+func (w *influxDBWriter) post(body string) (retryAfter time.Duration, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.writeURL, strings.NewReader(body))
+	if err != nil {
+		retryAfter = -1
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(w.token) != 0 {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return
+	}
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode/100 != 5 {
+		retryAfter = -1
+		return
+	}
+	if sec, parseErr := strconv.ParseUint(resp.Header.Get("Retry-After"), 10, 32); parseErr == nil {
+		retryAfter = time.Duration(sec) * time.Second
+	}
+	return
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+)
+
+// Protected by destinationState.mtx.
+type jitterState struct {
+	HasLastRTT bool
+	LastRTT    time.Duration
+	// In nanoseconds, not rounded to keep the smoothing accurate.
+	Jitter float64
+}
+
+// Fill in the RFC 3550 interarrival jitter and the instantaneous delay variation (RFC 3393).
+// Since we don't have synchronized clocks, the difference of RTT is used as the difference of transit time.
+func (app *appState) updateJitter(dest *destinationState, resp *icmpResponse) {
+	dest.mtx.Lock()
+	defer dest.mtx.Unlock()
+	j := &dest.jitter
+	if j.HasLastRTT {
+		resp.HasIPDV = true
+		resp.IPDV = resp.RTT - j.LastRTT
+		// https://www.rfc-editor.org/rfc/rfc3550#appendix-A.8
+		j.Jitter += (float64(resp.IPDV.Abs()) - j.Jitter) / 16
+	}
+	j.HasLastRTT = true
+	j.LastRTT = resp.RTT
+	resp.Jitter = time.Duration(j.Jitter)
+}
@@ -8,11 +8,19 @@ import (
 )
 
 func main() {
+	if params.IsReflector(os.Args) {
+		reflectorParams := params.ParseReflectorParams(os.Args)
+		runReflector(&reflectorParams)
+	}
 	params := params.ParseParams(os.Args)
 	state, err := NewApp(&params)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if params.PrometheusListen != "" {
+		state.startPrometheusExporter()
+	}
+	state.startSummaries()
 	state.startReceivers()
 	state.startSenders()
 }
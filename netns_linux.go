@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Run f with the calling goroutine in the network namespace name, so the sockets created by f belong to it.
+// An empty name means the current namespace. A name without a slash refers to /run/netns/NAME, as created by "ip netns add".
+func inNetns(name string, f func() error) error {
+	if len(name) == 0 {
+		return f()
+	}
+	path := name
+	if !strings.Contains(name, "/") {
+		path = filepath.Join("/run/netns", name)
+	}
+
+	runtime.LockOSThread()
+	orig, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return os.NewSyscallError("open", err)
+	}
+	defer unix.Close(orig)
+	target, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(target)
+	if err := unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return os.NewSyscallError("setns", err)
+	}
+
+	err = f()
+
+	if err := unix.Setns(orig, unix.CLONE_NEWNET); err != nil {
+		// Other goroutines must not run on this thread anymore.
+		log.Fatalf("failed to restore network namespace: %v\n", err)
+	}
+	runtime.UnlockOSThread()
+	return err
+}
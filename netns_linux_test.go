@@ -0,0 +1,140 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/sys/unix"
+)
+
+// Create a network namespace where 203.0.113.0/24 is only reachable by packets with firewall mark 1,
+// through a policy routing rule to a table with a local route.
+func newMarkNetns(t *testing.T) string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace requires root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("the ip command is not available")
+	}
+	name := fmt.Sprintf("telegraf-better-ping-test-%d", os.Getpid())
+	run := func(args ...string) {
+		t.Helper()
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatalf("ip %q failed: %v: %s", args, err, output)
+		}
+	}
+	run("netns", "add", name)
+	t.Cleanup(func() { exec.Command("ip", "netns", "delete", name).Run() })
+	run("-n", name, "link", "set", "lo", "up")
+	run("-n", name, "route", "add", "local", "203.0.113.0/24", "dev", "lo", "table", "100")
+	run("-n", name, "rule", "add", "fwmark", "1", "lookup", "100")
+	return name
+}
+
+func TestMarkPolicyRouting(t *testing.T) {
+	netns := newMarkNetns(t)
+
+	// The responder sits behind the same uplink, so its replies carry the same mark.
+	var echo net.PacketConn
+	err := inNetns(netns, func() (err error) {
+		lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}}
+		echo, err = lc.ListenPacket(context.Background(), "udp4", "0.0.0.0:0")
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		var buf [65536]byte
+		for {
+			n, addr, err := echo.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	port := echo.LocalAddr().(*net.UDPAddr).Port
+
+	tests := []struct {
+		name    string
+		hasMark bool
+		mark    uint32
+		sendErr error
+	}{
+		{"marked", true, 1, nil},
+		{"other mark", true, 2, syscall.ENETUNREACH},
+		{"unmarked", false, 0, syscall.ENETUNREACH},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, dest, output := newTestApp(t, params.DestinationParams{
+				Destination: "203.0.113.1",
+				HasMark:     tt.hasMark,
+				Mark:        tt.mark,
+				Netns:       netns,
+				Port:        uint16(port),
+				Probe:       "udp",
+				Protocol:    "ip4",
+				Size:        56,
+			})
+			ipv4Conn, _, err := app.createSendConn(dest.Params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The receiver treats a closed socket as fatal, so the socket is left open until the test binary exits.
+			app.startDestReceivers(dest, "UDP", ipv4Conn, nil, app.processUDPPacket)
+			crypt, err := app.rng.DeriveCipher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest.Cipher[0].Store(crypt)
+
+			const seq = 1
+			app.trackRequest(dest, seq)
+			packet, _ := app.prepareRequestBody(dest, seq, crypt)
+			_, err = ipv4Conn.WriteTo(packet, nil, app.remoteAddr(dest.Params, &net.IPAddr{IP: net.IPv4(203, 0, 113, 1)}))
+			if tt.sendErr != nil {
+				if !errors.Is(err, tt.sendErr) {
+					t.Fatalf("WriteTo() returned %v, want %v", err, tt.sendErr)
+				}
+				app.untrackRequest(dest, seq)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.recordSent(dest)
+
+			p := nextPoint(t, output)
+			if p["lost"] != false || p["icmp_seq"] != float64(seq) {
+				t.Errorf("got %v, want a reply of icmp_seq=%d", p, seq)
+			}
+			if p["mark"] != fmt.Sprint(tt.mark) || p["netns"] != netns {
+				t.Errorf("mark = %v, netns = %v, want %d, %s", p["mark"], p["netns"], tt.mark, netns)
+			}
+			if want := fmt.Sprintf("203.0.113.1:%d", port); p["reply_from"] != want {
+				t.Errorf("reply_from = %v, want %s", p["reply_from"], want)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func inNetns(name string, f func() error) error {
+	if len(name) == 0 {
+		return f()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/influxDB_escape"
+	"github.com/m13253/telegraf-better-ping/params"
+)
+
+type lineWriter interface {
+	WriteLine(line string)
+}
+
+type stdoutWriter struct{}
+
+func (stdoutWriter) WriteLine(line string) {
+	fmt.Print(line)
+}
+
+type point struct {
+	Measurement string
+	Tags        []pointTag
+	Fields      []pointField
+	Time        time.Time
+}
+
+type pointTag struct {
+	Key   string
+	Value string
+}
+
+// Value can be bool, float64, int64, string, time.Duration, or uint64.
+type pointField struct {
+	Key   string
+	Value any
+}
+
+// Append a tag, skipping empty values.
+func (p *point) AddTag(key, value string) {
+	if len(value) != 0 {
+		p.Tags = append(p.Tags, pointTag{Key: key, Value: value})
+	}
+}
+
+// Append the tags that identify a destination.
+func (p *point) AddDestinationTags(dest *params.DestinationParams) {
+	p.AddTag("host", dest.HostTag)
+	p.Tags = append(p.Tags, pointTag{Key: "dest", Value: dest.Destination})
+	p.AddTag("comment", dest.Comment)
+	if dest.Probe != "icmp" {
+		// Keep ICMP series unchanged, so existing dashboards still work.
+		p.AddTag("probe", dest.Probe)
+	}
+	if dest.HasDSCP {
+		p.AddTag("dscp", strconv.Itoa(int(dest.DSCP)))
+	}
+	p.AddTag("interface", dest.Interface)
+	if dest.HasMark {
+		p.AddTag("mark", strconv.FormatUint(uint64(dest.Mark), 10))
+	}
+	p.AddTag("netns", dest.Netns)
+	p.AddTag("responder", dest.Responder)
+}
+
+func (p *point) AddField(key string, value any) {
+	p.Fields = append(p.Fields, pointField{Key: key, Value: value})
+}
+
+func (app *appState) writePoint(p *point) {
+	if app.Params.OutputFormat == "json" {
+		app.output.WriteLine(encodeJSON(p))
+	} else {
+		app.output.WriteLine(app.encodeLineProtocol(p))
+	}
+}
+
+func (app *appState) encodeLineProtocol(p *point) string {
+	var sb strings.Builder
+	sb.WriteString(influxDB_escape.EscapeKey(p.Measurement))
+	for _, tag := range p.Tags {
+		sb.WriteString(fmt.Sprintf(",%s=%s", influxDB_escape.EscapeKey(tag.Key), influxDB_escape.EscapeKey(tag.Value)))
+	}
+	for i, field := range p.Fields {
+		if i == 0 {
+			sb.WriteByte(' ')
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(influxDB_escape.EscapeKey(field.Key))
+		sb.WriteByte('=')
+		switch value := field.Value.(type) {
+		case bool:
+			sb.WriteString(strconv.FormatBool(value))
+		case float64:
+			sb.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+		case int64:
+			sb.WriteString(fmt.Sprintf("%di", value))
+		case string:
+			sb.WriteString(influxDB_escape.EscapeValue(value))
+		case time.Duration:
+			sb.WriteString(formatSeconds(value))
+		case uint64:
+			sb.WriteString(fmt.Sprintf("%du", value))
+		default:
+			panic(fmt.Sprintf("unsupported field type: %T", value))
+		}
+	}
+	sb.WriteString(fmt.Sprintf(" %d\n", p.Time.UnixNano()))
+	return sb.String()
+}
+
+// Encode a point as a JSON object on a single line.
+// Tags and fields are flattened into the same object, after "measurement", "time", and "timestamp".
+func encodeJSON(p *point) string {
+	var sb strings.Builder
+	writeKey := func(key string) {
+		sb.WriteByte(',')
+		sb.Write(jsonString(key))
+		sb.WriteByte(':')
+	}
+	sb.WriteString(`{"measurement":`)
+	sb.Write(jsonString(p.Measurement))
+	writeKey("time")
+	sb.Write(jsonString(p.Time.UTC().Format(time.RFC3339Nano)))
+	writeKey("timestamp")
+	sb.WriteString(strconv.FormatInt(p.Time.UnixNano(), 10))
+	for _, tag := range p.Tags {
+		writeKey(tag.Key)
+		sb.Write(jsonString(tag.Value))
+	}
+	for _, field := range p.Fields {
+		writeKey(field.Key)
+		switch value := field.Value.(type) {
+		case bool:
+			sb.WriteString(strconv.FormatBool(value))
+		case float64:
+			sb.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+		case int64:
+			sb.WriteString(strconv.FormatInt(value, 10))
+		case string:
+			sb.Write(jsonString(value))
+		case time.Duration:
+			sb.WriteString(formatSeconds(value))
+		case uint64:
+			sb.WriteString(strconv.FormatUint(value, 10))
+		default:
+			panic(fmt.Sprintf("unsupported field type: %T", value))
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+func jsonString(s string) []byte {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// Format a time.Duration as seconds with exactly 9 decimal places, without losing precision.
+func formatSeconds(d time.Duration) string {
+	sign := ""
+	abs := uint64(d)
+	if d < 0 {
+		sign = "-"
+		abs = -abs
+	}
+	return fmt.Sprintf("%s%d.%09d", sign, abs/1000000000, abs%1000000000)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEncodePoint(t *testing.T) {
+	at := time.Date(2026, 10, 18, 1, 2, 3, 456789012, time.UTC)
+	tests := []struct {
+		name string
+		p    point
+		line string
+		json string
+	}{
+		{
+			"fields",
+			point{
+				Measurement: "ping",
+				Tags:        []pointTag{{"dest", "example.com"}},
+				Fields: []pointField{
+					{"bool", true},
+					{"float", 0.5},
+					{"int", int64(-3)},
+					{"string", "ok"},
+					{"rtt", 1500 * time.Microsecond},
+					{"uint", uint64(42)},
+				},
+				Time: at,
+			},
+			"ping,dest=example.com bool=true,float=0.5,int=-3i,string=\"ok\",rtt=0.001500000,uint=42u 1792285323456789012\n",
+			`{"measurement":"ping","time":"2026-10-18T01:02:03.456789012Z","timestamp":1792285323456789012,"dest":"example.com","bool":true,"float":0.5,"int":-3,"string":"ok","rtt":0.001500000,"uint":42}` + "\n",
+		},
+		{
+			"escaping",
+			point{
+				Measurement: "ping",
+				Tags:        []pointTag{{"comment", `a b,c=d`}},
+				Fields:      []pointField{{"error", `say "hi"\`}},
+				Time:        at,
+			},
+			"ping,comment=a\\ b\\,c\\=d error=\"say \\\"hi\\\"\\\\\" 1792285323456789012\n",
+			`{"measurement":"ping","time":"2026-10-18T01:02:03.456789012Z","timestamp":1792285323456789012,"comment":"a b,c=d","error":"say \"hi\"\\"}` + "\n",
+		},
+		{
+			"negative duration",
+			point{
+				Measurement: "ping",
+				Fields:      []pointField{{"ipdv", -2*time.Second - time.Nanosecond}},
+				Time:        at,
+			},
+			"ping ipdv=-2.000000001 1792285323456789012\n",
+			`{"measurement":"ping","time":"2026-10-18T01:02:03.456789012Z","timestamp":1792285323456789012,"ipdv":-2.000000001}` + "\n",
+		},
+	}
+	app := &appState{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := app.encodeLineProtocol(&tt.p); got != tt.line {
+				t.Errorf("encodeLineProtocol() = %q, want %q", got, tt.line)
+			}
+			got := encodeJSON(&tt.p)
+			if got != tt.json {
+				t.Errorf("encodeJSON() = %q, want %q", got, tt.json)
+			}
+			if !json.Valid([]byte(got)) {
+				t.Errorf("encodeJSON() = %q, not valid JSON", got)
+			}
+		})
+	}
+}
+
+func TestAddTag(t *testing.T) {
+	var p point
+	p.AddTag("host", "")
+	p.AddTag("comment", "x")
+	if len(p.Tags) != 1 || p.Tags[0] != (pointTag{"comment", "x"}) {
+		t.Errorf("AddTag() kept %+v, want only the non-empty tag", p.Tags)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -12,17 +14,49 @@ import (
 )
 
 type PingParams struct {
-	Destinations []DestinationParams
+	Destinations     []DestinationParams
+	InfluxBucket     string
+	InfluxOrg        string
+	InfluxToken      string
+	InfluxURL        string
+	OutputFormat     string
+	PrometheusListen string
 }
 
 type DestinationParams struct {
-	Comment     string
-	Source      string
-	Destination string
-	HostTag     string
-	Interval    time.Duration
-	Protocol    string
-	Size        uint16
+	Comment       string
+	DNSName       string
+	DNSTCP        bool
+	DNSType       uint16
+	Source        string
+	Destination   string
+	DSCP          uint8
+	HasDSCP       bool
+	HostTag       string
+	Interface     string
+	Interval      time.Duration
+	Mark          uint32
+	HasMark       bool
+	Multicast     time.Duration
+	Netns         string
+	Port          uint16
+	Probe         string
+	Protocol      string
+	Responder     string
+	Size          uint16
+	SummaryWindow time.Duration
+	SweepMax      uint16
+	SweepMin      uint16
+	SweepStep     uint16
+	Timeout       time.Duration
+	Trace         uint8
+	TTL           uint8
+	TxTimestamp   bool
+}
+
+// Whether the probe carries the ICMP echo identifier, sequence number, and payload.
+func (dest *DestinationParams) IsEcho() bool {
+	return dest.Probe == "icmp" || dest.Probe == "udp"
 }
 
 type Argument struct {
@@ -32,23 +66,49 @@ type Argument struct {
 }
 
 func ParseParams(args []string) PingParams {
-	var params PingParams
+	params := PingParams{
+		OutputFormat: "influx",
+		InfluxToken:  os.Getenv("INFLUX_TOKEN"),
+	}
 
 	waitNextDest := false
 	nextDest := DestinationParams{
+		DNSName:  ".",
+		DNSType:  2, // NS
 		Interval: time.Second,
+		Probe:    "icmp",
 		Protocol: "ip",
 		Size:     56,
+		Timeout:  10 * time.Second,
 	}
 
 	needValue := map[string]struct{}{
-		"":           {},
-		"--comment":  {},
-		"--dest":     {},
-		"--host-tag": {},
-		"-I":         {},
-		"-i":         {},
-		"-s":         {},
+		"":                    {},
+		"--comment":           {},
+		"--dest":              {},
+		"--dns-name":          {},
+		"--dns-type":          {},
+		"--dscp":              {},
+		"--host-tag":          {},
+		"--influx-bucket":     {},
+		"--influx-org":        {},
+		"--influx-token":      {},
+		"--influx-url":        {},
+		"--interface":         {},
+		"--mark":              {},
+		"--multicast":         {},
+		"--netns":             {},
+		"--output-format":     {},
+		"--probe":             {},
+		"--prometheus-listen": {},
+		"--summary":           {},
+		"--sweep":             {},
+		"--trace":             {},
+		"-I":                  {},
+		"-W":                  {},
+		"-i":                  {},
+		"-s":                  {},
+		"-t":                  {},
 	}
 	var arg0 string
 	for i, arg := range parseCommandLine(args, needValue) {
@@ -65,6 +125,45 @@ func ParseParams(args []string) PingParams {
 		}
 		switch arg.Option {
 		case "", "--dest":
+			if nextDest.Probe == "http" {
+				if u, err := url.Parse(arg.Value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+					printShortHelp(arg0, fmt.Sprintf("destination must be an HTTP or HTTPS URL for option --probe=http: %q", arg.Value))
+				}
+			}
+			if nextDest.Probe == "timestamp" && nextDest.Protocol == "ip6" {
+				printShortHelp(arg0, fmt.Sprintf("option --probe=timestamp does not support IPv6: %q", arg.Value))
+			}
+			if nextDest.Trace != 0 && nextDest.Probe != "icmp" && nextDest.Probe != "tcp" && nextDest.Probe != "udp" {
+				printShortHelp(arg0, fmt.Sprintf("option --trace only supports --probe=icmp, tcp, or udp: %q", arg.Value))
+			}
+			if nextDest.TTL != 0 && nextDest.Probe != "icmp" && nextDest.Probe != "udp" && nextDest.Probe != "stamp" && nextDest.Probe != "timestamp" {
+				printShortHelp(arg0, fmt.Sprintf("option -t only supports --probe=icmp, udp, stamp, or timestamp: %q", arg.Value))
+			}
+			if nextDest.HasDSCP && nextDest.Probe != "icmp" && nextDest.Probe != "udp" && nextDest.Probe != "stamp" && nextDest.Probe != "timestamp" {
+				printShortHelp(arg0, fmt.Sprintf("option --dscp only supports --probe=icmp, udp, stamp, or timestamp: %q", arg.Value))
+			}
+			if nextDest.Multicast != 0 && !nextDest.IsEcho() {
+				printShortHelp(arg0, fmt.Sprintf("option --multicast only supports --probe=icmp or udp: %q", arg.Value))
+			}
+			if nextDest.Multicast != 0 && nextDest.TxTimestamp {
+				printShortHelp(arg0, fmt.Sprintf("option --multicast does not support --tx-timestamp: %q", arg.Value))
+			}
+			if nextDest.TxTimestamp && !nextDest.IsEcho() {
+				printShortHelp(arg0, fmt.Sprintf("option --tx-timestamp only supports --probe=icmp or udp: %q", arg.Value))
+			}
+			if nextDest.SweepStep != 0 && nextDest.Probe != "icmp" {
+				printShortHelp(arg0, fmt.Sprintf("option --sweep only supports --probe=icmp: %q", arg.Value))
+			}
+			if len(nextDest.Netns) != 0 {
+				// Go resolves host names in other threads, which are outside the namespace.
+				host := arg.Value
+				if u, err := url.Parse(arg.Value); err == nil && nextDest.Probe == "http" {
+					host = u.Hostname()
+				}
+				if _, err := netip.ParseAddr(host); err != nil {
+					printShortHelp(arg0, fmt.Sprintf("destination must be an IP address for option --netns: %q", arg.Value))
+				}
+			}
 			nextDest.Destination = arg.Value
 			params.Destinations = append(params.Destinations, nextDest)
 			waitNextDest = false
@@ -76,11 +175,108 @@ func ParseParams(args []string) PingParams {
 		case "--comment":
 			waitNextDest = true
 			nextDest.Comment = arg.Value
+		case "--dns-name":
+			waitNextDest = true
+			nextDest.DNSName = arg.Value
+		case "--dns-tcp":
+			waitNextDest = true
+			nextDest.DNSTCP = true
+		case "--dns-type":
+			waitNextDest = true
+			if dnsType, ok := parseDNSType(arg.Value); ok {
+				nextDest.DNSType = dnsType
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid type for option --dns-type: %q", arg.Value))
+			}
+		case "--dns-udp":
+			waitNextDest = true
+			nextDest.DNSTCP = false
+		case "--dscp":
+			waitNextDest = true
+			if dscp, err := strconv.ParseUint(arg.Value, 10, 8); err == nil && dscp <= 63 {
+				nextDest.DSCP = uint8(dscp)
+				nextDest.HasDSCP = true
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid DSCP for option --dscp: %q", arg.Value))
+			}
 		case "--help":
 			printHelp(arg0)
 		case "--host-tag":
 			waitNextDest = true
 			nextDest.HostTag = arg.Value
+		case "--influx-bucket":
+			params.InfluxBucket = arg.Value
+		case "--influx-org":
+			params.InfluxOrg = arg.Value
+		case "--influx-token":
+			params.InfluxToken = arg.Value
+		case "--influx-url":
+			params.InfluxURL = arg.Value
+		case "--interface":
+			waitNextDest = true
+			nextDest.Interface = arg.Value
+		case "--mark":
+			waitNextDest = true
+			if mark, err := strconv.ParseUint(arg.Value, 0, 32); err == nil {
+				nextDest.Mark = uint32(mark)
+				nextDest.HasMark = true
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid mark for option --mark: %q", arg.Value))
+			}
+		case "--multicast":
+			waitNextDest = true
+			if timeout, err := strconv.ParseFloat(arg.Value, 64); err == nil && timeout >= 0 && timeout <= math.MaxInt64/float64(time.Second) {
+				nextDest.Multicast = time.Duration(math.Ceil(timeout * float64(time.Second)))
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid timeout for option --multicast: %q", arg.Value))
+			}
+		case "--netns":
+			waitNextDest = true
+			nextDest.Netns = arg.Value
+		case "--output-format":
+			switch arg.Value {
+			case "influx", "json":
+				params.OutputFormat = arg.Value
+			default:
+				printShortHelp(arg0, fmt.Sprintf("invalid format for option --output-format: %q", arg.Value))
+			}
+		case "--prometheus-listen":
+			params.PrometheusListen = arg.Value
+		case "--probe":
+			waitNextDest = true
+			if probe, port, ok := parseProbe(arg.Value); ok {
+				nextDest.Probe = probe
+				nextDest.Port = port
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid probe for option --probe: %q", arg.Value))
+			}
+		case "--summary":
+			waitNextDest = true
+			if window, err := strconv.ParseFloat(arg.Value, 64); err == nil && window >= 0 && window <= math.MaxInt64/float64(time.Second) {
+				nextDest.SummaryWindow = time.Duration(math.Ceil(window * float64(time.Second)))
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid window for option --summary: %q", arg.Value))
+			}
+		case "--sweep":
+			waitNextDest = true
+			if sweepMin, sweepMax, sweepStep, ok := parseSweep(arg.Value); ok {
+				nextDest.SweepMin, nextDest.SweepMax, nextDest.SweepStep = sweepMin, sweepMax, sweepStep
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid sizes for option --sweep: %q", arg.Value))
+			}
+		case "--trace":
+			waitNextDest = true
+			if hops, err := strconv.ParseUint(arg.Value, 10, 8); err == nil {
+				nextDest.Trace = uint8(hops)
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid number of hops for option --trace: %q", arg.Value))
+			}
+		case "--tx-timestamp":
+			waitNextDest = true
+			nextDest.TxTimestamp = true
+		case "--no-tx-timestamp":
+			waitNextDest = true
+			nextDest.TxTimestamp = false
 		case "-4":
 			waitNextDest = true
 			nextDest.Protocol = "ip4"
@@ -90,6 +286,13 @@ func ParseParams(args []string) PingParams {
 		case "-I":
 			waitNextDest = true
 			nextDest.Source = arg.Value
+		case "-W":
+			waitNextDest = true
+			if timeout, err := strconv.ParseFloat(arg.Value, 64); err == nil && timeout > 0 && timeout <= math.MaxInt64/float64(time.Second) {
+				nextDest.Timeout = time.Duration(math.Ceil(timeout * float64(time.Second)))
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid timeout for option -W: %q", arg.Value))
+			}
 		case "-i":
 			waitNextDest = true
 			if interval, err := strconv.ParseFloat(arg.Value, 64); err == nil && interval >= 0.002 {
@@ -104,6 +307,13 @@ func ParseParams(args []string) PingParams {
 			} else {
 				printShortHelp(arg0, fmt.Sprintf("invalid interval for option -s: %s", arg.Value))
 			}
+		case "-t":
+			waitNextDest = true
+			if ttl, err := strconv.ParseUint(arg.Value, 10, 8); err == nil {
+				nextDest.TTL = uint8(ttl)
+			} else {
+				printShortHelp(arg0, fmt.Sprintf("invalid TTL for option -t: %q", arg.Value))
+			}
 		default:
 			printShortHelp(arg0, fmt.Sprintf("invalid option: %q", arg.Option))
 		}
@@ -115,9 +325,95 @@ func ParseParams(args []string) PingParams {
 	if len(params.Destinations) == 0 {
 		printShortHelp(arg0, "you must specify at least one destination.")
 	}
+	if len(params.InfluxURL) != 0 && len(params.InfluxBucket) == 0 {
+		printShortHelp(arg0, "option --influx-url requires --influx-bucket.")
+	}
+	if len(params.InfluxURL) != 0 && params.OutputFormat != "influx" {
+		printShortHelp(arg0, "option --influx-url requires --output-format=influx.")
+	}
 	return params
 }
 
+// Parse MIN:MAX:STEP, or "0" to disable sweeping.
+func parseSweep(value string) (sweepMin, sweepMax, sweepStep uint16, ok bool) {
+	if value == "0" {
+		return 0, 0, 0, true
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return
+	}
+	var nums [3]uint16
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return
+		}
+		nums[i] = uint16(n)
+	}
+	sweepMin, sweepMax, sweepStep = nums[0], nums[1], nums[2]
+	ok = sweepMin <= sweepMax && sweepMax <= 65528 && sweepStep != 0
+	return
+}
+
+var defaultPorts = map[string]uint16{
+	"dns":   53,
+	"stamp": 862,
+}
+
+func parseProbe(value string) (probe string, port uint16, ok bool) {
+	probe, portStr, hasPort := strings.Cut(value, ":")
+	switch probe {
+	case "http", "icmp", "timestamp":
+		ok = !hasPort
+	case "dns", "stamp":
+		if !hasPort {
+			port = defaultPorts[probe]
+			ok = true
+			break
+		}
+		fallthrough
+	case "tcp", "udp":
+		if hasPort {
+			if p, err := strconv.ParseUint(portStr, 10, 16); err == nil && p != 0 {
+				port = uint16(p)
+				ok = true
+			}
+		}
+	}
+	return
+}
+
+var dnsTypes = map[string]uint16{
+	"A":      1,
+	"NS":     2,
+	"CNAME":  5,
+	"SOA":    6,
+	"PTR":    12,
+	"MX":     15,
+	"TXT":    16,
+	"AAAA":   28,
+	"SRV":    33,
+	"DS":     43,
+	"DNSKEY": 48,
+	"HTTPS":  65,
+	"CAA":    257,
+}
+
+// Accept either a type name, or "TYPE" followed by a number (RFC 3597).
+func parseDNSType(value string) (dnsType uint16, ok bool) {
+	value = strings.ToUpper(value)
+	if dnsType, ok = dnsTypes[value]; ok {
+		return
+	}
+	if num, found := strings.CutPrefix(value, "TYPE"); found {
+		if t, err := strconv.ParseUint(num, 10, 16); err == nil {
+			return uint16(t), true
+		}
+	}
+	return
+}
+
 func printShortHelp(arg0 string, message string) {
 	fmt.Fprintf(os.Stderr, `Usage:
   %s {[OPTIONS] [--dest] DESTINATION} [[OPTIONS] [--dest] DESTINATION]...
@@ -131,27 +427,103 @@ Use "%s --help" for detailed information.
 func printHelp(arg0 string) {
 	fmt.Printf(`Usage:
   %s {[OPTIONS] [--dest=]DESTINATION} [[OPTIONS] [--dest=]DESTINATION]...
+  %s reflector [--listen=ADDR]...
 
 Options:
   --comment=COMMENT     Comment of the following destination.
   [--dest=]DESTINATION  The destination address to send packets to.
                         The text "--dest=" can be omitted.
+  --dscp=DSCP           Set the DSCP of sent packets, from 0 to 63, e.g., 46 for
+                        EF, and add a "dscp" tag. Only supported by icmp, udp,
+                        stamp, and timestamp probes.
+  --dns-name=NAME       The name to query with --probe=dns. The default is ".".
+  --dns-type=TYPE       The type to query with --probe=dns. The default is NS.
+  --dns-tcp             Send DNS queries over TCP.
+  --dns-udp             Send DNS queries over UDP. The default mode.
   --host-tag TAG        Add an extra "host" tag to the InfluxDB entries.
+  --interface=IFACE     Bind sockets to the network interface or VRF device IFACE,
+                        and add an "interface" tag. Linux only.
+  --mark=MARK           Set the firewall mark of sockets, for policy routing,
+                        and add a "mark" tag. Needs CAP_NET_ADMIN. Linux only.
+  --multicast=TIMEOUT   Expect replies from several hosts, for multicast or
+                        broadcast destinations, and print each responding
+                        address as its own series with a "responder" tag.
+                        Responders without a reply for TIMEOUT seconds are
+                        reported as gone. Only supported by icmp and udp
+                        probes. The default is 0, which disables it.
+  --netns=NAME          Open sockets inside the network namespace NAME, as created
+                        by "ip netns add", or at the path NAME if it contains a
+                        slash, and add a "netns" tag. Destinations must be IP
+                        addresses. Linux only.
   --prefer-ipv6         Prefer IPv6 / ICMPv6 protocol,
                         fallback to IPv4 / ICMP. The default mode.
+  --probe=PROBE         The type of packets to send:
+                        "icmp" for ICMP / ICMPv6 echo requests (the default),
+                        "udp:PORT" for UDP packets to an echo service at
+                        PORT, which must send back the same payload,
+                        "tcp:PORT" for TCP handshakes to PORT,
+                        "timestamp" for ICMP timestamp requests (IPv4 only),
+                        "http" for HTTP(S) GET requests, in which case
+                        DESTINATION must be a URL, "dns[:PORT]" for DNS
+                        queries to the DNS server at PORT (default 53), or
+                        "stamp[:PORT]" for STAMP / TWAMP-Light test packets
+                        to the reflector at PORT (default 862).
+  --summary=WINDOW      Additionally print a "ping_summary" measurement every
+                        WINDOW seconds, with packet counts, loss ratio, and
+                        RTT statistics. The default is 0, which disables it.
+  --sweep=MIN:MAX:STEP  Additionally send ICMP / ICMPv6 echo requests with the
+                        DF bit set, with data sizes from MIN to MAX bytes in
+                        steps of STEP, one size per interval, and print
+                        "ping_sweep" and "ping_pmtu" measurements. Linux only.
+                        The default is 0, which disables it.
+  --trace=MAX_HOPS      Additionally send probes with increasing TTL / hop limit
+                        up to MAX_HOPS every interval, like MTR, and print a
+                        "ping_hop" measurement per hop. Only works with icmp,
+                        udp, and tcp probes. The default is 0, which disables it.
+  --tx-timestamp        Subtract the time requests spend in the kernel before
+                        leaving from the RTT, using transmit timestamps, and
+                        print it as "send_delay". Only supported by icmp and udp
+                        probes. Linux only.
+  --no-tx-timestamp     Measure the RTT from the send call. The default mode.
   -4                    Use IPv4 / ICMP protocol.
   -6                    Use IPv6 / ICMPv6 protocol.
   -I SOURCE             The source address to send packets from.
+  -W TIMEOUT            Wait TIMEOUT seconds for a reply before reporting the
+                        packet as lost. The default is 10 seconds.
   -i INTERVAL           Wait INTERVAL seconds between sending each packet.
                         Must be greater or equal to 0.002 seconds.
   -s SIZE               The number of data bytes to be sent. The default is 56.
                         Must be between 40 and 65528.
+  -t TTL                Set the IPv4 TTL or IPv6 hop limit of sent packets.
+                        Only supported by icmp, udp, stamp, and timestamp
+                        probes. The default is 0, which uses the system default.
+
+Global options:
+  --influx-url=URL      Write measurements to the InfluxDB server at URL,
+                        instead of the standard output.
+                        Both InfluxDB v2 and v3 are supported.
+                        Timestamps are always written in nanoseconds, as
+                        each point needs a unique timestamp, which a coarser
+                        precision cannot give without drifting ahead.
+  --influx-bucket=BUCKET
+                        The bucket (or database) to write into.
+  --influx-org=ORG      The organization to write into.
+  --influx-token=TOKEN  The API token. The default is taken from the
+                        environment variable INFLUX_TOKEN.
+  --output-format=FORMAT
+                        Print measurements to the standard output in FORMAT:
+                        "influx" for InfluxDB line protocol (the default),
+                        or "json" for JSON Lines.
+  --prometheus-listen=ADDR
+                        Serve Prometheus metrics at http://ADDR/metrics,
+                        in addition to the standard output.
 
 Notes:
-  All options, except for --comment, only affect the destinations followed by.
+  All options, except for --comment and global options, only affect the destinations followed by.
   The option --comment only affects the single destination followed by.
   The last command line argument must be a destination.
-`, arg0)
+  Use "%s reflector --help" for options of the STAMP reflector.
+`, arg0, arg0, arg0)
 	os.Exit(0)
 }
 
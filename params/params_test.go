@@ -0,0 +1,151 @@
+package params
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		check func(dest *DestinationParams) bool
+	}{
+		{"summary", []string{"--summary=60", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.SummaryWindow == time.Minute
+		}},
+		{"udp", []string{"--probe=udp:7", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Probe == "udp" && d.Port == 7
+		}},
+		{"dns type", []string{"--probe=dns", "--dns-type=TYPE65", "--dns-tcp", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Probe == "dns" && d.Port == 53 && d.DNSType == 65 && d.DNSTCP
+		}},
+		{"stamp default port", []string{"--probe=stamp", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Probe == "stamp" && d.Port == 862
+		}},
+		{"stamp port", []string{"--probe=stamp:8620", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Probe == "stamp" && d.Port == 8620
+		}},
+		{"timestamp", []string{"--probe=timestamp", "-4", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Probe == "timestamp" && d.Protocol == "ip4"
+		}},
+		{"trace udp", []string{"--probe=udp:33434", "--trace=30", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Trace == 30
+		}},
+		{"sweep", []string{"--sweep=64:1472:64", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.SweepMin == 64 && d.SweepMax == 1472 && d.SweepStep == 64
+		}},
+		{"ttl", []string{"-t", "5", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.TTL == 5
+		}},
+		{"ttl stamp", []string{"--probe=stamp", "-t", "255", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Probe == "stamp" && d.TTL == 255
+		}},
+		{"dscp", []string{"--dscp=46", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.HasDSCP && d.DSCP == 46
+		}},
+		{"dscp zero", []string{"--dscp", "0", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.HasDSCP && d.DSCP == 0
+		}},
+		{"dscp stamp", []string{"--probe=stamp", "--dscp=10", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Probe == "stamp" && d.HasDSCP && d.DSCP == 10
+		}},
+		{"interface", []string{"--interface=eth0", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Interface == "eth0"
+		}},
+		{"netns", []string{"--netns=blue", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.Netns == "blue"
+		}},
+		{"netns ipv6 with zone", []string{"--netns=blue", "fe80::1%eth0"}, func(d *DestinationParams) bool {
+			return d.Netns == "blue" && d.Destination == "fe80::1%eth0"
+		}},
+		{"netns http", []string{"--netns=blue", "--probe=http", "http://[2001:db8::1]:8080/"}, func(d *DestinationParams) bool {
+			return d.Netns == "blue" && d.Probe == "http"
+		}},
+		{"mark", []string{"--mark=42", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.HasMark && d.Mark == 42
+		}},
+		{"mark hex", []string{"--mark=0xffffffff", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.HasMark && d.Mark == 0xffffffff
+		}},
+		{"tx timestamp", []string{"--tx-timestamp", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.TxTimestamp
+		}},
+		{"tx timestamp udp", []string{"--probe=udp:7", "--tx-timestamp", "192.0.2.1"}, func(d *DestinationParams) bool {
+			return d.TxTimestamp && d.Probe == "udp"
+		}},
+		{"multicast", []string{"--multicast=2.5", "224.0.0.1"}, func(d *DestinationParams) bool {
+			return d.Multicast == 2500*time.Millisecond
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := ParseParams(append([]string{"telegraf-better-ping"}, tt.args...))
+			if len(params.Destinations) != 1 {
+				t.Fatalf("got %d destinations, want 1", len(params.Destinations))
+			}
+			if dest := &params.Destinations[0]; !tt.check(dest) {
+				t.Errorf("ParseParams(%q) = %+v", tt.args, *dest)
+			}
+		})
+	}
+}
+
+func TestParseParamsMarks(t *testing.T) {
+	params := ParseParams([]string{"telegraf-better-ping", "--comment=uplink 1", "--mark=1", "192.0.2.1", "--mark=2", "192.0.2.1"})
+	if len(params.Destinations) != 2 {
+		t.Fatalf("got %d destinations, want 2", len(params.Destinations))
+	}
+	// The same destination may be listed once for each mark. Options apply to the following destinations, except --comment.
+	first, second := &params.Destinations[0], &params.Destinations[1]
+	if first.Comment != "uplink 1" || first.Mark != 1 || second.Comment != "" || second.Mark != 2 {
+		t.Errorf("ParseParams() = %+v, %+v, want marks 1 and 2, and the comment only on the first", *first, *second)
+	}
+}
+
+// Invalid options exit the process, so each case runs in a child process.
+func TestParseParamsErrors(t *testing.T) {
+	if args, ok := os.LookupEnv("TEST_PARSE_PARAMS_ARGS"); ok {
+		ParseParams(append([]string{"telegraf-better-ping"}, strings.Split(args, "\n")...))
+		os.Exit(0)
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		message string
+	}{
+		{"output format", []string{"--output-format=csv", "192.0.2.1"}, "invalid format for option --output-format"},
+		{"udp without port", []string{"--probe=udp", "192.0.2.1"}, "invalid probe for option --probe"},
+		{"stamp port zero", []string{"--probe=stamp:0", "192.0.2.1"}, "invalid probe for option --probe"},
+		{"timestamp ipv6", []string{"--probe=timestamp", "-6", "2001:db8::1"}, "option --probe=timestamp does not support IPv6"},
+		{"trace stamp", []string{"--trace=30", "--probe=stamp", "192.0.2.1"}, "option --trace only supports"},
+		{"sweep udp", []string{"--sweep=64:128:8", "--probe=udp:7", "192.0.2.1"}, "option --sweep only supports"},
+		{"sweep step zero", []string{"--sweep=64:128:0", "192.0.2.1"}, "invalid sizes for option --sweep"},
+		{"ttl tcp", []string{"-t", "5", "--probe=tcp:80", "192.0.2.1"}, "option -t only supports"},
+		{"dscp too large", []string{"--dscp=64", "192.0.2.1"}, "invalid DSCP for option --dscp"},
+		{"dscp http", []string{"--dscp=46", "--probe=http", "http://192.0.2.1/"}, "option --dscp only supports"},
+		{"netns host name", []string{"--netns=blue", "example.com"}, "destination must be an IP address for option --netns"},
+		{"netns http host name", []string{"--netns=blue", "--probe=http", "http://example.com/"}, "destination must be an IP address for option --netns"},
+		{"mark too large", []string{"--mark=0x100000000", "192.0.2.1"}, "invalid mark for option --mark"},
+		{"tx timestamp stamp", []string{"--tx-timestamp", "--probe=stamp", "192.0.2.1"}, "option --tx-timestamp only supports"},
+		{"multicast negative", []string{"--multicast=-1", "224.0.0.1"}, "invalid timeout for option --multicast"},
+		{"multicast tcp", []string{"--multicast=1", "--probe=tcp:80", "224.0.0.1"}, "option --multicast only supports"},
+		{"multicast tx timestamp", []string{"--multicast=1", "--tx-timestamp", "224.0.0.1"}, "option --multicast does not support --tx-timestamp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestParseParamsErrors$")
+			cmd.Env = append(os.Environ(), "TEST_PARSE_PARAMS_ARGS="+strings.Join(tt.args, "\n"))
+			output, err := cmd.CombinedOutput()
+			if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+				t.Fatalf("ParseParams(%q) exited with %v, want exit status 1", tt.args, err)
+			}
+			if !strings.Contains(string(output), tt.message) {
+				t.Errorf("ParseParams(%q) printed %q, want %q", tt.args, output, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package params
+
+import (
+	"fmt"
+	"os"
+)
+
+type ReflectorParams struct {
+	Listen []string
+}
+
+// Whether the command line asks for the reflector subcommand.
+func IsReflector(args []string) bool {
+	return len(args) >= 2 && args[1] == "reflector"
+}
+
+func ParseReflectorParams(args []string) ReflectorParams {
+	var params ReflectorParams
+
+	needValue := map[string]struct{}{
+		"":         {},
+		"--listen": {},
+	}
+	arg0 := args[0] + " reflector"
+	for i, arg := range parseCommandLine(args[1:], needValue) {
+		if i == 0 {
+			continue
+		}
+		if _, ok := needValue[arg.Option]; ok {
+			if !arg.HasValue {
+				printReflectorShortHelp(arg0, fmt.Sprintf("option %s requires an argument", arg.Option))
+			}
+		} else if arg.HasValue {
+			printReflectorShortHelp(arg0, fmt.Sprintf("option %s requires no argument", arg.Option))
+		}
+		switch arg.Option {
+		case "--help":
+			printReflectorHelp(arg0)
+		case "--listen":
+			params.Listen = append(params.Listen, arg.Value)
+		case "":
+			printReflectorShortHelp(arg0, fmt.Sprintf("unexpected argument: %q", arg.Value))
+		default:
+			printReflectorShortHelp(arg0, fmt.Sprintf("invalid option: %q", arg.Option))
+		}
+	}
+
+	if len(params.Listen) == 0 {
+		params.Listen = []string{"0.0.0.0:862", "[::]:862"}
+	}
+	return params
+}
+
+func printReflectorShortHelp(arg0 string, message string) {
+	fmt.Fprintf(os.Stderr, `Usage:
+  %s [--listen=ADDR]...
+
+Error: %s
+Use "%s --help" for detailed information.
+`, arg0, message, arg0)
+	os.Exit(1)
+}
+
+func printReflectorHelp(arg0 string) {
+	fmt.Printf(`Usage:
+  %s [--listen=ADDR]...
+
+Reflect STAMP / TWAMP-Light test packets back to the sender.
+
+Options:
+  --listen=ADDR         The UDP address to listen on. Can be specified more
+                        than once. The default is 0.0.0.0:862 and [::]:862.
+`, arg0)
+	os.Exit(0)
+}
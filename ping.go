@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Number of attempts to get the same ICMP identifier for both IPv4 and IPv6 datagram sockets.
+const pingListenAttempts = 8
+
+// Open unprivileged ICMP datagram sockets, which are allowed by net.ipv4.ping_group_range on Linux.
+// The kernel assigns the ICMP identifier and overwrites the one we send, so it replaces the random dest.ID.
+// The IPv6 socket is bound to the same identifier as the IPv4 one, so the encrypted payload stays the same for both.
+func (app *appState) createPingConn(dest *destinationState) (ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn, err error) {
+	switch dest.Params.Protocol {
+	case "ip":
+		for range pingListenAttempts {
+			var (
+				id      uint16
+				ipv6ID  uint16
+				ipv4Err error
+				ipv6Err error
+			)
+			ipv4Conn, id, ipv4Err = listenPingIPv4(dest.Params)
+			ipv6Conn, ipv6ID, ipv6Err = listenPingIPv6(dest.Params, id)
+			if errors.Is(ipv6Err, errPingIDInUse) {
+				ipv4Conn.Close()
+				ipv4Conn = nil
+				continue
+			}
+			if ipv4Err != nil && ipv6Err != nil {
+				err = fmt.Errorf("failed to create ICMP datagram socket for destination %s: %w", dest.Params.Destination, pingError(ipv4Err))
+				return
+			}
+			if ipv4Err != nil {
+				id = ipv6ID
+			}
+			if id != 0 {
+				dest.ID = id
+			}
+			return
+		}
+		err = fmt.Errorf("failed to create ICMP datagram socket for destination %s: %w", dest.Params.Destination, errPingIDInUse)
+	case "ip4":
+		var id uint16
+		ipv4Conn, id, err = listenPingIPv4(dest.Params)
+		if err != nil {
+			err = fmt.Errorf("failed to create ICMP datagram socket for destination %s: %w", dest.Params.Destination, pingError(err))
+			return
+		}
+		if id != 0 {
+			dest.ID = id
+		}
+	case "ip6":
+		var id uint16
+		ipv6Conn, id, err = listenPingIPv6(dest.Params, 0)
+		if err != nil {
+			err = fmt.Errorf("failed to create ICMP datagram socket for destination %s: %w", dest.Params.Destination, pingError(err))
+			return
+		}
+		if id != 0 {
+			dest.ID = id
+		}
+	default:
+		panic(fmt.Sprintf("unknown protocol: %q", dest.Params.Protocol))
+	}
+	return
+}
+
+var errPingIDInUse = errors.New("ICMP identifier is already in use")
+
+func pingError(err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%w (check sysctl net.ipv4.ping_group_range)", err)
+	}
+	return err
+}
+
+func (app *appState) processPingPacket(dest *destinationState, isIPv6 bool, packet []byte, src net.Addr, info *packetInfo) {
+	proto, replyType := 1, icmp.Type(ipv4.ICMPTypeEchoReply)
+	if isIPv6 {
+		proto, replyType = 58, ipv6.ICMPTypeEchoReply
+	}
+	msg, err := icmp.ParseMessage(proto, packet)
+	if err != nil {
+		log.Printf("failed to decode ICMP message from %s: %v\n", src.String(), err)
+		return
+	}
+	if body, ok := msg.Body.(*icmp.Echo); ok && msg.Type == replyType {
+		app.processDestResponse(dest, len(packet), pingSource(src), info, body)
+	}
+}
+
+// Datagram sockets report the source as a UDP address, print it the same way as raw sockets.
+func pingSource(src net.Addr) net.Addr {
+	if udpAddr, ok := src.(*net.UDPAddr); ok {
+		return &net.IPAddr{IP: udpAddr.IP, Zone: udpAddr.Zone}
+	}
+	return src
+}
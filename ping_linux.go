@@ -0,0 +1,119 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// Open an ICMP datagram socket, and return the ICMP identifier assigned by the kernel.
+func listenPingIPv4(dest *params.DestinationParams) (ipv4Conn *ipv4.PacketConn, id uint16, err error) {
+	conn, id, err := listenPing(false, dest, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ipv4.NewPacketConn(conn), id, nil
+}
+
+// Open an ICMPv6 datagram socket bound to the ICMP identifier id, or any identifier if id is 0.
+// Return the identifier assigned by the kernel.
+func listenPingIPv6(dest *params.DestinationParams, id uint16) (ipv6Conn *ipv6.PacketConn, assignedID uint16, err error) {
+	conn, assignedID, err := listenPing(true, dest, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ipv6.NewPacketConn(conn), assignedID, nil
+}
+
+// The socket is created by hand instead of icmp.ListenPacket, so we can bind to a specific identifier and set socket options.
+func listenPing(isIPv6 bool, dest *params.DestinationParams, id uint16) (conn net.PacketConn, assignedID uint16, err error) {
+	var (
+		fd int
+		sa unix.Sockaddr
+	)
+	if isIPv6 {
+		addr := &net.IPAddr{IP: net.IPv6unspecified}
+		if len(dest.Source) != 0 {
+			if addr, err = net.ResolveIPAddr("ip6", dest.Source); err != nil {
+				return
+			}
+		}
+		sa6 := &unix.SockaddrInet6{Port: int(id)}
+		copy(sa6.Addr[:], addr.IP.To16())
+		if addr.Zone != "" {
+			if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+				sa6.ZoneId = uint32(ifi.Index)
+			}
+		}
+		sa = sa6
+		fd, err = socketInNetns(dest.Netns, unix.AF_INET6, unix.IPPROTO_ICMPV6)
+	} else {
+		addr := &net.IPAddr{IP: net.IPv4zero}
+		if len(dest.Source) != 0 {
+			if addr, err = net.ResolveIPAddr("ip4", dest.Source); err != nil {
+				return
+			}
+		}
+		sa4 := &unix.SockaddrInet4{Port: int(id)}
+		copy(sa4.Addr[:], addr.IP.To4())
+		sa = sa4
+		fd, err = socketInNetns(dest.Netns, unix.AF_INET, unix.IPPROTO_ICMP)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := setDeviceAndMark(fd, dest); err != nil {
+		unix.Close(fd)
+		return nil, 0, err
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		if errors.Is(err, unix.EADDRINUSE) {
+			return nil, 0, errPingIDInUse
+		}
+		return nil, 0, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(fd), "datagram-oriented icmp")
+	conn, err = net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := setRecvErr(conn.(syscall.Conn), isIPv6); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if err := setRxTimestamp(conn.(syscall.Conn)); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if !isIPv6 {
+		if err := setRecvTOS(conn.(syscall.Conn)); err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+	}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		assignedID = uint16(addr.Port)
+	}
+	return conn, assignedID, nil
+}
+
+func socketInNetns(netns string, domain, proto int) (fd int, err error) {
+	err = inNetns(netns, func() error {
+		fd, err = unix.Socket(domain, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+		if err != nil {
+			return os.NewSyscallError("socket", err)
+		}
+		return nil
+	})
+	return
+}
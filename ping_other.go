@@ -0,0 +1,44 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func listenPingIPv4(dest *params.DestinationParams) (ipv4Conn *ipv4.PacketConn, id uint16, err error) {
+	if len(dest.Interface) != 0 || len(dest.Netns) != 0 || dest.HasMark {
+		return nil, 0, errors.ErrUnsupported
+	}
+	icmpConn, err := icmp.ListenPacket("udp4", dest.Source)
+	if err != nil {
+		return nil, 0, err
+	}
+	return icmpConn.IPv4PacketConn(), pingID(icmpConn), nil
+}
+
+// Other systems do not overwrite the ICMP identifier, so there is no need to bind to a specific one.
+func listenPingIPv6(dest *params.DestinationParams, id uint16) (ipv6Conn *ipv6.PacketConn, assignedID uint16, err error) {
+	if len(dest.Interface) != 0 || len(dest.Netns) != 0 || dest.HasMark {
+		return nil, 0, errors.ErrUnsupported
+	}
+	icmpConn, err := icmp.ListenPacket("udp6", dest.Source)
+	if err != nil {
+		return nil, 0, err
+	}
+	return icmpConn.IPv6PacketConn(), id, nil
+}
+
+// Return the ICMP identifier assigned by the kernel, or 0 if the system does not assign one.
+func pingID(icmpConn *icmp.PacketConn) uint16 {
+	if addr, ok := icmpConn.LocalAddr().(*net.UDPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var dnsRCodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// Send a DNS query to the destination, using the sequence number as the query ID.
+func (app *appState) sendDNSProbe(dest *destinationState, seq uint16, addrs []string) {
+	addr := pickAddr(dest.Params, addrs)
+	if addr == nil {
+		app.untrackRequest(dest, seq)
+		log.Printf("failed to ping %s: no available address\n", dest.Params.Destination)
+		return
+	}
+	query, question, err := buildDNSQuery(dest, seq)
+	if err != nil {
+		app.untrackRequest(dest, seq)
+		log.Printf("failed to ping %s: %v\n", dest.Params.Destination, err)
+		return
+	}
+
+	network := "udp"
+	if dest.Params.DNSTCP {
+		network = "tcp"
+	}
+	dialer := net.Dialer{
+		Timeout: probeTimeout(dest),
+	}
+	if len(dest.Params.Source) != 0 {
+		if network == "tcp" {
+			dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(dest.Params.Source)}
+		} else {
+			dialer.LocalAddr = &net.UDPAddr{IP: net.ParseIP(dest.Params.Source)}
+		}
+	}
+
+	app.recordSent(dest)
+	sendTime := time.Now()
+	conn, err := dialContext(context.Background(), dest.Params, &dialer, network, net.JoinHostPort(addr.String(), strconv.Itoa(int(dest.Params.Port))))
+	if err != nil {
+		logProbeError(dest, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(sendTime.Add(dialer.Timeout))
+	resp, err := exchangeDNS(conn, dest.Params.DNSTCP, query, seq, question)
+	recvTime := time.Now()
+	if err != nil {
+		logProbeError(dest, err)
+		return
+	}
+
+	rcode, ok := dnsRCodeNames[resp.RCode]
+	if !ok {
+		rcode = strconv.Itoa(int(resp.RCode))
+	}
+	r := &icmpResponse{
+		Fields: []pointField{
+			{Key: "rcode", Value: rcode},
+			{Key: "answers", Value: uint64(len(resp.Answers))},
+			{Key: "truncated", Value: resp.Truncated},
+		},
+		Params:    dest.Params,
+		RecvTime:  app.nextUnixTime(recvTime),
+		ReplyFrom: conn.RemoteAddr(),
+		RTT:       recvTime.Sub(sendTime),
+		Seq:       seq,
+	}
+	switch localAddr := conn.LocalAddr().(type) {
+	case *net.TCPAddr:
+		r.ReplyTo = &net.IPAddr{IP: localAddr.IP, Zone: localAddr.Zone}
+	case *net.UDPAddr:
+		r.ReplyTo = &net.IPAddr{IP: localAddr.IP, Zone: localAddr.Zone}
+	}
+	app.reportResponse(dest, r)
+}
+
+func buildDNSQuery(dest *destinationState, seq uint16) (query []byte, question dnsmessage.Question, err error) {
+	fqdn := dest.Params.DNSName
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return
+	}
+	question = dnsmessage.Question{
+		Name:  name,
+		Type:  dnsmessage.Type(dest.Params.DNSType),
+		Class: dnsmessage.ClassINET,
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               seq,
+		RecursionDesired: true,
+	})
+	if err = builder.StartQuestions(); err != nil {
+		return
+	}
+	if err = builder.Question(question); err != nil {
+		return
+	}
+	query, err = builder.Finish()
+	return
+}
+
+// Send the query and wait for the matching response.
+// Over UDP, responses with mismatching ID or question are ignored, as they may be late responses of earlier queries.
+func exchangeDNS(conn net.Conn, tcp bool, query []byte, id uint16, question dnsmessage.Question) (resp *dnsmessage.Message, err error) {
+	var buf [65536]byte
+	if tcp {
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(query)))
+		if _, err = conn.Write(append(length[:], query...)); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint16(length[:])
+		if _, err = io.ReadFull(conn, buf[:n]); err != nil {
+			return
+		}
+		resp, err = parseDNSResponse(buf[:n], id, question)
+		return
+	}
+	if _, err = conn.Write(query); err != nil {
+		return
+	}
+	for {
+		var n int
+		n, err = conn.Read(buf[:])
+		if err != nil {
+			return
+		}
+		resp, err = parseDNSResponse(buf[:n], id, question)
+		if err == nil {
+			return
+		}
+	}
+}
+
+func parseDNSResponse(packet []byte, id uint16, question dnsmessage.Question) (resp *dnsmessage.Message, err error) {
+	resp = new(dnsmessage.Message)
+	if err = resp.Unpack(packet); err != nil {
+		return nil, fmt.Errorf("failed to decode DNS response: %w", err)
+	}
+	if !resp.Response || resp.ID != id {
+		return nil, errors.New("mismatching DNS response ID")
+	}
+	// A truncated response may not contain the question section.
+	if len(resp.Questions) != 0 && resp.Questions[0] != question {
+		return nil, errors.New("mismatching DNS response question")
+	}
+	return
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Issue a GET request to the destination URL through a new connection, and measure the time of each phase.
+func (app *appState) sendHTTPProbe(dest *destinationState, seq uint16) {
+	network := "tcp"
+	switch dest.Params.Protocol {
+	case "ip4":
+		network = "tcp4"
+	case "ip6":
+		network = "tcp6"
+	}
+	dialer := &net.Dialer{}
+	if len(dest.Params.Source) != 0 {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(dest.Params.Source)}
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialContext(ctx, dest.Params, dialer, network, addr)
+		},
+		DisableKeepAlives: true,
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   probeTimeout(dest),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			// Measure the destination itself, not where it redirects to.
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// Callbacks may be called from other goroutines, for example when dialing IPv4 and IPv6 in parallel.
+	var (
+		mtx                       sync.Mutex
+		dnsStart, dnsDone         time.Time
+		connectStart, connectDone time.Time
+		tlsStart, tlsDone         time.Time
+		firstByte                 time.Time
+		peer, localAddr           net.Addr
+	)
+	stamp := func(t *time.Time) {
+		now := time.Now()
+		mtx.Lock()
+		*t = now
+		mtx.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { stamp(&dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { stamp(&dnsDone) },
+		ConnectStart:      func(string, string) { stamp(&connectStart) },
+		ConnectDone:       func(string, string, error) { stamp(&connectDone) },
+		TLSHandshakeStart: func() { stamp(&tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { stamp(&tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			mtx.Lock()
+			peer = info.Conn.RemoteAddr()
+			localAddr = info.Conn.LocalAddr()
+			mtx.Unlock()
+		},
+		GotFirstResponseByte: func() { stamp(&firstByte) },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, dest.Params.Destination, nil)
+	if err != nil {
+		app.untrackRequest(dest, seq)
+		log.Printf("failed to ping %s: %v\n", dest.Params.Destination, err)
+		return
+	}
+	req.Header.Set("User-Agent", "telegraf-better-ping")
+
+	app.recordSent(dest)
+	sendTime := time.Now()
+	resp, err := client.Do(req)
+	var bodySize int64
+	if err == nil {
+		bodySize, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	recvTime := time.Now()
+	if err != nil {
+		logProbeError(dest, err)
+		return
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	fields := make([]pointField, 0, 6)
+	if !dnsStart.IsZero() && !dnsDone.IsZero() {
+		fields = append(fields, pointField{Key: "dns_time", Value: dnsDone.Sub(dnsStart)})
+	}
+	if !connectStart.IsZero() && !connectDone.IsZero() {
+		fields = append(fields, pointField{Key: "connect_time", Value: connectDone.Sub(connectStart)})
+	}
+	if !tlsStart.IsZero() && !tlsDone.IsZero() {
+		fields = append(fields, pointField{Key: "tls_time", Value: tlsDone.Sub(tlsStart)})
+	}
+	if !firstByte.IsZero() {
+		fields = append(fields, pointField{Key: "ttfb", Value: firstByte.Sub(sendTime)})
+	}
+	fields = append(fields,
+		pointField{Key: "status_code", Value: uint64(resp.StatusCode)},
+		pointField{Key: "body_size", Value: uint64(bodySize)},
+	)
+	r := &icmpResponse{
+		Fields:    fields,
+		Params:    dest.Params,
+		RecvTime:  app.nextUnixTime(recvTime),
+		ReplyFrom: peer,
+		RTT:       recvTime.Sub(sendTime),
+		Seq:       seq,
+	}
+	if localAddr, ok := localAddr.(*net.TCPAddr); ok {
+		r.ReplyTo = &net.IPAddr{IP: localAddr.IP, Zone: localAddr.Zone}
+	}
+	app.reportResponse(dest, r)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+)
+
+func TestHTTPProbe(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/")
+		w.WriteHeader(http.StatusFound)
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	// The certificate is not trusted, so the probe fails.
+	tlsServer := httptest.NewTLSServer(mux)
+	defer tlsServer.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		lost       bool
+		statusCode float64
+		bodySize   float64
+	}{
+		{"ok", server.URL + "/", false, 200, 5},
+		{"redirect not followed", server.URL + "/redirect", false, 302, 0},
+		{"server error", server.URL + "/error", false, 500, 5},
+		{"untrusted certificate", tlsServer.URL + "/", true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, dest, output := newTestApp(t, params.DestinationParams{
+				Destination: tt.url,
+				Probe:       "http",
+				Protocol:    "ip",
+				Timeout:     500 * time.Millisecond,
+			})
+			const seq = 1
+			app.trackRequest(dest, seq)
+			app.sendHTTPProbe(dest, seq)
+
+			p := nextPoint(t, output)
+			if p["probe"] != "http" || p["dest"] != tt.url || p["lost"] != tt.lost {
+				t.Fatalf("got %v, want probe=http, dest=%s, lost=%v", p, tt.url, tt.lost)
+			}
+			if tt.lost {
+				return
+			}
+			if p["status_code"] != tt.statusCode || p["body_size"] != tt.bodySize {
+				t.Errorf("status_code = %v, body_size = %v, want %v, %v", p["status_code"], p["body_size"], tt.statusCode, tt.bodySize)
+			}
+			if p["reply_from"] != server.Listener.Addr().String() {
+				t.Errorf("reply_from = %v, want %s", p["reply_from"], server.Listener.Addr())
+			}
+			if p["reply_to"] != "127.0.0.1" {
+				t.Errorf("reply_to = %v, want 127.0.0.1", p["reply_to"])
+			}
+			for _, key := range []string{"rtt", "connect_time", "ttfb"} {
+				if d, ok := p[key].(float64); !ok || d <= 0 || d >= 5 {
+					t.Errorf("%s = %v, want between 0 and 5 seconds", key, p[key])
+				}
+			}
+			if _, ok := p["tls_time"]; ok {
+				t.Errorf("tls_time = %v, want none for plain HTTP", p["tls_time"])
+			}
+		})
+	}
+}
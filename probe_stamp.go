@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/stamp"
+)
+
+// The sequence number of STAMP is 32-bit long, we only use the lower 16 bits.
+func marshalSTAMPRequest(seq uint16) []byte {
+	packet := stamp.SenderPacket{
+		Seq:       uint32(seq),
+		Timestamp: time.Now(),
+	}
+	return packet.Marshal()
+}
+
+// Split the round trip into both directions, using the timestamps of the Session-Reflector:
+//
+//	T1 = Session-Sender Timestamp, T2 = Receive Timestamp, T3 = Timestamp, T4 = info.RecvTime
+//	rtt = (T4 - T1) - (T3 - T2), owd_fwd = T2 - T1, owd_rev = T4 - T3
+//
+// T4 - T1 is measured on the monotonic clock while the request is in flight, so clock steps do not affect it.
+// One-way delays are only meaningful if both clocks are synchronized.
+func (app *appState) processSTAMPPacket(dest *destinationState, isIPv6 bool, packet []byte, src net.Addr, info *packetInfo) {
+	if udpSrc, ok := src.(*net.UDPAddr); !ok || udpSrc.Port != int(dest.Params.Port) {
+		return
+	}
+	reply, err := stamp.ParseReflectorPacket(packet)
+	if err != nil {
+		log.Printf("failed to decode STAMP message from %s: %v\n", src, err)
+		return
+	}
+	seq := uint16(reply.SenderSeq)
+	var rtt time.Duration
+	if sendTime, ok := app.requestSendTime(dest, seq); ok {
+		rtt = info.RecvTimeSinceEpoch - sendTime.Sub(app.epoch)
+	} else {
+		// Late replies are no longer in flight, fall back to the Session-Sender Timestamp.
+		rtt = info.RecvTime.Sub(reply.SenderTimestamp)
+	}
+	resp := &icmpResponse{
+		HasHopLimit: info.HasHopLimit,
+		HasTOS:      info.HasTOS,
+		HopLimit:    info.HopLimit,
+		Params:      dest.Params,
+		RecvTime:    info.RecvTime,
+		RxTimestamp: info.TimestampSource,
+		ReplyFrom:   src,
+		ReplyTo:     info.Dst,
+		RTT:         rtt - reply.Timestamp.Sub(reply.ReceiveTime),
+		Seq:         seq,
+		Size:        len(packet),
+		TOS:         info.TOS,
+		Fields: []pointField{
+			{Key: "owd_fwd", Value: reply.ReceiveTime.Sub(reply.SenderTimestamp)},
+			{Key: "owd_rev", Value: info.RecvTime.Sub(reply.Timestamp)},
+			{Key: "reflector_rx_time", Value: reply.ReceiveTime.UnixNano()},
+			{Key: "reflector_tx_time", Value: reply.Timestamp.UnixNano()},
+		},
+	}
+	if reply.SenderTTL != 0 {
+		resp.Fields = append(resp.Fields, pointField{Key: "fwd_hop_limit", Value: uint64(reply.SenderTTL)})
+	}
+	app.reportResponse(dest, resp)
+}
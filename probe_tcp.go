@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Measure the time from sending SYN to receiving SYN-ACK (or RST), by connecting and closing immediately.
+func (app *appState) sendTCPProbe(dest *destinationState, seq uint16, addrs []string) {
+	addr := pickAddr(dest.Params, addrs)
+	if addr == nil {
+		app.untrackRequest(dest, seq)
+		log.Printf("failed to ping %s: no available address\n", dest.Params.Destination)
+		return
+	}
+	dialer := net.Dialer{
+		Timeout: probeTimeout(dest),
+	}
+	if len(dest.Params.Source) != 0 {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(dest.Params.Source)}
+	}
+	remote := net.JoinHostPort(addr.String(), strconv.Itoa(int(dest.Params.Port)))
+
+	app.recordSent(dest)
+	sendTime := time.Now()
+	conn, err := dialContext(context.Background(), dest.Params, &dialer, "tcp", remote)
+	recvTime := time.Now()
+
+	refused := errors.Is(err, syscall.ECONNREFUSED)
+	if err != nil && !refused {
+		logProbeError(dest, err)
+		return
+	}
+	resp := &icmpResponse{
+		Params:   dest.Params,
+		RecvTime: app.nextUnixTime(recvTime),
+		RTT:      recvTime.Sub(sendTime),
+		Seq:      seq,
+		Fields:   []pointField{{Key: "refused", Value: refused}},
+	}
+	if refused {
+		resp.ReplyFrom = &net.TCPAddr{IP: addr.IP, Port: int(dest.Params.Port), Zone: addr.Zone}
+	} else {
+		resp.ReplyFrom = conn.RemoteAddr()
+		if localAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			resp.ReplyTo = &net.IPAddr{IP: localAddr.IP, Zone: localAddr.Zone}
+		}
+		// Send RST instead of FIN, so no socket is left in TIME_WAIT state.
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+	app.reportResponse(dest, resp)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// ICMP Timestamp and Timestamp Reply messages, after the ICMP type, code, and checksum:
+//
+//	+--------+--------+--------+--------+
+//	|   Identifier    | Sequence Number |
+//	+--------+--------+--------+--------+
+//	|       Originate Timestamp         |
+//	+--------+--------+--------+--------+
+//	|        Receive Timestamp          |
+//	+--------+--------+--------+--------+
+//	|        Transmit Timestamp         |
+//	+--------+--------+--------+--------+
+//
+// Timestamps are milliseconds since midnight UT. If the high bit is set, the value is in a non-standard unit.
+// https://www.rfc-editor.org/rfc/rfc792
+const (
+	icmpTimestampLen     = 16
+	msPerDay             = 24 * 60 * 60 * 1000
+	nonStandardTimestamp = 1 << 31
+)
+
+func timestampMillis(t time.Time) uint32 {
+	return uint32(t.UnixMilli() % msPerDay)
+}
+
+// Difference between two timestamps in milliseconds, assuming they are less than 12 hours apart across midnight.
+func timestampDiff(a, b uint32) int64 {
+	diff := (int64(a) - int64(b)) % msPerDay
+	if diff >= msPerDay/2 {
+		diff -= msPerDay
+	} else if diff < -msPerDay/2 {
+		diff += msPerDay
+	}
+	return diff
+}
+
+func marshalTimestampRequest(dest *destinationState, seq uint16) []byte {
+	data := make([]byte, icmpTimestampLen)
+	binary.BigEndian.PutUint16(data[0:2], dest.ID)
+	binary.BigEndian.PutUint16(data[2:4], seq)
+	binary.BigEndian.PutUint32(data[4:8], timestampMillis(time.Now()))
+	packet, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeTimestamp,
+		Body: &icmp.RawBody{Data: data},
+	}).Marshal(nil)
+	if err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+// Unlike echo replies, timestamp replies carry no payload to decrypt, so they are matched by the identifier only.
+func (app *appState) processTimestampResponse(size int, src net.Addr, info *packetInfo, body *icmp.RawBody) {
+	if len(body.Data) < icmpTimestampLen {
+		log.Printf("failed to decode ICMP message from %s: body is less than %d bytes long\n", src, icmpTimestampLen)
+		return
+	}
+	id := binary.BigEndian.Uint16(body.Data[0:2])
+	seq := binary.BigEndian.Uint16(body.Data[2:4])
+	originate := binary.BigEndian.Uint32(body.Data[4:8])
+	receive := binary.BigEndian.Uint32(body.Data[8:12])
+	transmit := binary.BigEndian.Uint32(body.Data[12:16])
+	now := timestampMillis(info.RecvTime)
+
+	for i := range app.Destinations {
+		dest := &app.Destinations[i]
+		if dest.Params.Probe != "timestamp" || id != dest.ID {
+			continue
+		}
+
+		var rtt time.Duration
+		if sendTime, ok := app.requestSendTime(dest, seq); ok {
+			rtt = info.RecvTimeSinceEpoch - sendTime.Sub(app.epoch)
+		} else {
+			// Late replies are no longer in flight, fall back to the originate timestamp.
+			rtt = time.Duration(timestampDiff(now, originate)) * time.Millisecond
+		}
+		nonStandard := receive&nonStandardTimestamp != 0 || transmit&nonStandardTimestamp != 0
+		resp := &icmpResponse{
+			HasHopLimit: info.HasHopLimit,
+			HasTOS:      info.HasTOS,
+			HopLimit:    info.HopLimit,
+			ID:          id,
+			Params:      dest.Params,
+			RecvTime:    info.RecvTime,
+			RxTimestamp: info.TimestampSource,
+			ReplyFrom:   src,
+			ReplyTo:     info.Dst,
+			RTT:         rtt,
+			Seq:         seq,
+			Size:        size,
+			TOS:         info.TOS,
+			Fields:      []pointField{{Key: "nonstandard_clock", Value: nonStandard}},
+		}
+		if !nonStandard {
+			resp.Fields = append(resp.Fields,
+				pointField{Key: "fwd_ms", Value: timestampDiff(receive, originate)},
+				pointField{Key: "rev_ms", Value: timestampDiff(now, transmit)},
+			)
+		}
+		app.reportResponse(dest, resp)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// UDP probes carry the same payload as ICMP echo requests, without the ICMP type, code, and checksum:
+//
+//	+--------+--------+--------+--------+--------
+//	|   Identifier    | Sequence Number | Data ...
+//	+--------+--------+--------+--------+--------
+const udpEchoHeaderLen = 4
+
+func marshalUDPEcho(body *icmp.Echo) []byte {
+	packet := make([]byte, udpEchoHeaderLen+len(body.Data))
+	binary.BigEndian.PutUint16(packet[0:2], uint16(body.ID))
+	binary.BigEndian.PutUint16(packet[2:4], uint16(body.Seq))
+	copy(packet[udpEchoHeaderLen:], body.Data)
+	return packet
+}
+
+func parseUDPEcho(packet []byte) (body *icmp.Echo, ok bool) {
+	if len(packet) < udpEchoHeaderLen {
+		return
+	}
+	return &icmp.Echo{
+		ID:   int(binary.BigEndian.Uint16(packet[0:2])),
+		Seq:  int(binary.BigEndian.Uint16(packet[2:4])),
+		Data: packet[udpEchoHeaderLen:],
+	}, true
+}
+
+func listenUDPv4(dest *params.DestinationParams) (*ipv4.PacketConn, error) {
+	udpConn, err := listenPacket(dest, "udp4", net.JoinHostPort(dest.Source, "0"))
+	if err != nil {
+		return nil, err
+	}
+	return ipv4.NewPacketConn(udpConn), nil
+}
+
+func listenUDPv6(dest *params.DestinationParams) (*ipv6.PacketConn, error) {
+	udpConn, err := listenPacket(dest, "udp6", net.JoinHostPort(dest.Source, "0"))
+	if err != nil {
+		return nil, err
+	}
+	return ipv6.NewPacketConn(udpConn), nil
+}
+
+const udpRecvErrFeature = "ICMP errors of UDP and STAMP probes"
+
+// Send sockets of UDP and STAMP probes also receive ICMP errors through the socket error queue, if supported.
+func (app *appState) listenUDPSendv4(dest *params.DestinationParams) (*ipv4.PacketConn, error) {
+	udpConn, err := listenPacket(dest, "udp4", net.JoinHostPort(dest.Source, "0"))
+	if err != nil {
+		return nil, err
+	}
+	// Without them, ICMP errors and the DSCP of replies are simply not reported, and RTTs are measured from the time replies are read.
+	app.warnOnce(udpRecvErrFeature, setRecvErr(udpConn.(syscall.Conn), false))
+	_ = setRecvTOS(udpConn.(syscall.Conn))
+	_ = setRxTimestamp(udpConn.(syscall.Conn))
+	return ipv4.NewPacketConn(udpConn), nil
+}
+
+func (app *appState) listenUDPSendv6(dest *params.DestinationParams) (*ipv6.PacketConn, error) {
+	udpConn, err := listenPacket(dest, "udp6", net.JoinHostPort(dest.Source, "0"))
+	if err != nil {
+		return nil, err
+	}
+	app.warnOnce(udpRecvErrFeature, setRecvErr(udpConn.(syscall.Conn), true))
+	_ = setRxTimestamp(udpConn.(syscall.Conn))
+	return ipv6.NewPacketConn(udpConn), nil
+}
+
+func (app *appState) processUDPPacket(dest *destinationState, isIPv6 bool, packet []byte, src net.Addr, info *packetInfo) {
+	body, ok := parseUDPEcho(packet)
+	if !ok {
+		log.Printf("failed to decode UDP message from %s: message is too short\n", src.String())
+		return
+	}
+	app.processResponse("udp", len(packet), src, info, body)
+}
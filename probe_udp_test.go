@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/icmp"
+)
+
+func TestParseUDPEcho(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		body   *icmp.Echo
+	}{
+		{"empty", nil, nil},
+		{"too short", []byte{0x12, 0x34, 0x00}, nil},
+		{"header only", []byte{0x12, 0x34, 0x00, 0x07}, &icmp.Echo{ID: 0x1234, Seq: 7, Data: []byte{}}},
+		{"with data", []byte{0xff, 0xff, 0xff, 0xfe, 1, 2, 3}, &icmp.Echo{ID: 0xffff, Seq: 0xfffe, Data: []byte{1, 2, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, ok := parseUDPEcho(tt.packet)
+			if ok != (tt.body != nil) {
+				t.Fatalf("parseUDPEcho() ok = %v, want %v", ok, tt.body != nil)
+			}
+			if !ok {
+				return
+			}
+			if body.ID != tt.body.ID || body.Seq != tt.body.Seq || !bytes.Equal(body.Data, tt.body.Data) {
+				t.Errorf("parseUDPEcho() = %+v, want %+v", body, tt.body)
+			}
+			if packet := marshalUDPEcho(body); !bytes.Equal(packet, tt.packet) {
+				t.Errorf("marshalUDPEcho() = %x, want %x", packet, tt.packet)
+			}
+		})
+	}
+}
+
+// Collect the printed points of a test.
+type chanWriter chan string
+
+func (w chanWriter) WriteLine(line string) {
+	w <- line
+}
+
+// Start an app with a single destination, with its output collected in JSON.
+func newTestApp(t *testing.T, dest params.DestinationParams) (*appState, *destinationState, chanWriter) {
+	t.Helper()
+	if dest.Interval == 0 {
+		dest.Interval = time.Second
+	}
+	if dest.Timeout == 0 {
+		dest.Timeout = 10 * time.Second
+	}
+	app, err := NewApp(&params.PingParams{
+		Destinations: []params.DestinationParams{dest},
+		OutputFormat: "json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chanWriter, 16)
+	app.output = output
+	return app, &app.Destinations[0], output
+}
+
+// Wait for the next printed point.
+func nextPoint(t *testing.T, output chanWriter) map[string]any {
+	t.Helper()
+	select {
+	case line := <-output:
+		var p map[string]any
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			t.Fatalf("failed to decode %q: %v", line, err)
+		}
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no point printed within 5 seconds")
+		return nil
+	}
+}
+
+func TestUDPProbe(t *testing.T) {
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		var buf [65536]byte
+		for {
+			n, addr, err := echo.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// A port with nobody listening, which replies with ICMP port unreachable.
+	closed, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.LocalAddr().(*net.UDPAddr).Port
+	closed.Close()
+
+	tests := []struct {
+		name string
+		port int
+		lost bool
+		// ICMP errors of UDP probes are only received on Linux.
+		linuxOnly bool
+		fields    map[string]any
+	}{
+		{"echo", echo.LocalAddr().(*net.UDPAddr).Port, false, false, map[string]any{
+			"duplicate":  false,
+			"reply_from": echo.LocalAddr().String(),
+			"size":       float64(udpEchoHeaderLen + 56),
+		}},
+		{"port unreachable", closedPort, true, true, map[string]any{
+			"error": "destination unreachable: port unreachable",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linuxOnly && runtime.GOOS != "linux" {
+				t.Skip("not supported on", runtime.GOOS)
+			}
+			app, dest, output := newTestApp(t, params.DestinationParams{
+				Destination: "127.0.0.1",
+				Port:        uint16(tt.port),
+				Probe:       "udp",
+				Protocol:    "ip4",
+				Size:        56,
+			})
+			ipv4Conn, _, err := app.createSendConn(dest.Params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The receiver treats a closed socket as fatal, so the socket is left open until the test binary exits.
+			app.startDestReceivers(dest, "UDP", ipv4Conn, nil, app.processUDPPacket)
+			crypt, err := app.rng.DeriveCipher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest.Cipher[0].Store(crypt)
+
+			const seq = 65535
+			app.trackRequest(dest, seq)
+			packet, _ := app.prepareRequestBody(dest, seq, crypt)
+			if _, err := ipv4Conn.WriteTo(packet, nil, app.remoteAddr(dest.Params, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})); err != nil {
+				t.Fatal(err)
+			}
+			app.recordSent(dest)
+
+			p := nextPoint(t, output)
+			if p["probe"] != "udp" || p["icmp_seq"] != float64(seq) || p["icmp_id"] != float64(dest.ID) || p["lost"] != tt.lost {
+				t.Errorf("got %v, want probe=udp, icmp_seq=%d, icmp_id=%d, lost=%v", p, seq, dest.ID, tt.lost)
+			}
+			for key, want := range tt.fields {
+				if p[key] != want {
+					t.Errorf("%s = %v, want %v", key, p[key], want)
+				}
+			}
+			if !tt.lost {
+				if rtt, ok := p["rtt"].(float64); !ok || rtt <= 0 || rtt >= 5 {
+					t.Errorf("rtt = %v, want between 0 and 5 seconds", p["rtt"])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"github.com/m13253/telegraf-better-ping/prometheus_escape"
+)
+
+// Upper bounds of the RTT histogram buckets, in seconds.
+var rttBuckets = [...]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Protected by destinationState.mtx.
+type destinationMetrics struct {
+	Sent        uint64
+	Received    uint64
+	Lost        uint64
+	Late        uint64
+	Duplicates  uint64
+	Reordered   uint64
+	LossBursts  uint64
+	HasRTT      bool
+	LastRTT     time.Duration
+	HasHopLimit bool
+	HopLimit    uint8
+	RTTBuckets  [len(rttBuckets)]uint64
+	RTTCount    uint64
+	RTTSum      time.Duration
+}
+
+func (app *appState) startPrometheusExporter() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", app.servePrometheusMetrics)
+	go func() {
+		err := http.ListenAndServe(app.Params.PrometheusListen, mux)
+		log.Fatalf("failed to serve Prometheus metrics on %s: %v\n", app.Params.PrometheusListen, err)
+	}()
+}
+
+func (app *appState) servePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	var (
+		labels    []string
+		snapshots []destinationMetrics
+	)
+	for i := range app.Destinations {
+		for _, dest := range app.seriesOf(&app.Destinations[i]) {
+			dest.mtx.Lock()
+			snapshots = append(snapshots, dest.metrics)
+			dest.mtx.Unlock()
+			labels = append(labels, prometheusLabels(dest.Params))
+		}
+	}
+
+	var sb strings.Builder
+	writeFamily := func(name, kind, help string, write func(labels string, m *destinationMetrics)) {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind))
+		for i := range snapshots {
+			write(labels[i], &snapshots[i])
+		}
+	}
+	writeFamily("better_ping_sent_total", "counter", "Number of requests sent.", func(labels string, m *destinationMetrics) {
+		sb.WriteString(fmt.Sprintf("better_ping_sent_total{%s} %d\n", labels, m.Sent))
+	})
+	writeFamily("better_ping_received_total", "counter", "Number of replies received before the timeout.", func(labels string, m *destinationMetrics) {
+		sb.WriteString(fmt.Sprintf("better_ping_received_total{%s} %d\n", labels, m.Received))
+	})
+	writeFamily("better_ping_lost_total", "counter", "Number of requests without a reply before the timeout.", func(labels string, m *destinationMetrics) {
+		sb.WriteString(fmt.Sprintf("better_ping_lost_total{%s} %d\n", labels, m.Lost))
+	})
+	writeFamily("better_ping_loss_bursts_total", "counter", "Number of runs of consecutive lost requests that have ended.", func(labels string, m *destinationMetrics) {
+		sb.WriteString(fmt.Sprintf("better_ping_loss_bursts_total{%s} %d\n", labels, m.LossBursts))
+	})
+	writeFamily("better_ping_late_total", "counter", "Number of replies received after the timeout.", func(labels string, m *destinationMetrics) {
+		sb.WriteString(fmt.Sprintf("better_ping_late_total{%s} %d\n", labels, m.Late))
+	})
+	writeFamily("better_ping_duplicates_total", "counter", "Number of duplicated replies.", func(labels string, m *destinationMetrics) {
+		sb.WriteString(fmt.Sprintf("better_ping_duplicates_total{%s} %d\n", labels, m.Duplicates))
+	})
+	writeFamily("better_ping_reordered_total", "counter", "Number of replies arriving after a reply with a greater sequence number.", func(labels string, m *destinationMetrics) {
+		sb.WriteString(fmt.Sprintf("better_ping_reordered_total{%s} %d\n", labels, m.Reordered))
+	})
+	writeFamily("better_ping_last_rtt_seconds", "gauge", "Round-trip time of the last reply.", func(labels string, m *destinationMetrics) {
+		if m.HasRTT {
+			sb.WriteString(fmt.Sprintf("better_ping_last_rtt_seconds{%s} %.9f\n", labels, m.LastRTT.Seconds()))
+		}
+	})
+	writeFamily("better_ping_last_hop_limit", "gauge", "IPv4 TTL or IPv6 hop limit of the last reply.", func(labels string, m *destinationMetrics) {
+		if m.HasHopLimit {
+			sb.WriteString(fmt.Sprintf("better_ping_last_hop_limit{%s} %d\n", labels, m.HopLimit))
+		}
+	})
+	writeFamily("better_ping_rtt_seconds", "histogram", "Round-trip time of replies.", func(labels string, m *destinationMetrics) {
+		for i, bound := range rttBuckets {
+			sb.WriteString(fmt.Sprintf("better_ping_rtt_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, m.RTTBuckets[i]))
+		}
+		sb.WriteString(fmt.Sprintf("better_ping_rtt_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, m.RTTCount))
+		sb.WriteString(fmt.Sprintf("better_ping_rtt_seconds_sum{%s} %.9f\n", labels, m.RTTSum.Seconds()))
+		sb.WriteString(fmt.Sprintf("better_ping_rtt_seconds_count{%s} %d\n", labels, m.RTTCount))
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
+
+// Same as point.AddDestinationTags.
+func prometheusLabels(dest *params.DestinationParams) string {
+	var sb strings.Builder
+	if len(dest.HostTag) != 0 {
+		sb.WriteString(fmt.Sprintf("host=%s,", prometheus_escape.EscapeLabelValue(dest.HostTag)))
+	}
+	sb.WriteString(fmt.Sprintf("dest=%s", prometheus_escape.EscapeLabelValue(dest.Destination)))
+	if len(dest.Comment) != 0 {
+		sb.WriteString(fmt.Sprintf(",comment=%s", prometheus_escape.EscapeLabelValue(dest.Comment)))
+	}
+	if dest.Probe != "icmp" {
+		sb.WriteString(fmt.Sprintf(",probe=%s", prometheus_escape.EscapeLabelValue(dest.Probe)))
+	}
+	if dest.HasDSCP {
+		sb.WriteString(fmt.Sprintf(",dscp=%s", prometheus_escape.EscapeLabelValue(strconv.Itoa(int(dest.DSCP)))))
+	}
+	if len(dest.Interface) != 0 {
+		sb.WriteString(fmt.Sprintf(",interface=%s", prometheus_escape.EscapeLabelValue(dest.Interface)))
+	}
+	if dest.HasMark {
+		sb.WriteString(fmt.Sprintf(",mark=%s", prometheus_escape.EscapeLabelValue(strconv.FormatUint(uint64(dest.Mark), 10))))
+	}
+	if len(dest.Netns) != 0 {
+		sb.WriteString(fmt.Sprintf(",netns=%s", prometheus_escape.EscapeLabelValue(dest.Netns)))
+	}
+	if len(dest.Responder) != 0 {
+		sb.WriteString(fmt.Sprintf(",responder=%s", prometheus_escape.EscapeLabelValue(dest.Responder)))
+	}
+	return sb.String()
+}
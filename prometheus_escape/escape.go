@@ -0,0 +1,15 @@
+package prometheus_escape
+
+import (
+	"strings"
+)
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func EscapeLabelValue(value string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	sb.WriteString(labelValueReplacer.Replace(value))
+	sb.WriteByte('"')
+	return sb.String()
+}
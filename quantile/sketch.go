@@ -0,0 +1,72 @@
+package quantile
+
+import (
+	"math"
+	"sort"
+)
+
+// Sketch estimates quantiles of non-negative values in constant memory,
+// with a bounded relative error (DDSketch, https://arxiv.org/abs/1908.10693).
+type Sketch struct {
+	gamma    float64
+	logGamma float64
+	buckets  map[int]uint64
+	zeros    uint64
+	count    uint64
+}
+
+// Values smaller than this are counted as zero.
+const minIndexableValue = 1e-9
+
+func NewSketch(relativeAccuracy float64) *Sketch {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &Sketch{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		buckets:  make(map[int]uint64),
+	}
+}
+
+func (s *Sketch) Add(value float64) {
+	s.count++
+	if value < minIndexableValue {
+		s.zeros++
+		return
+	}
+	s.buckets[int(math.Ceil(math.Log(value)/s.logGamma))]++
+}
+
+func (s *Sketch) Count() uint64 {
+	return s.count
+}
+
+// Return the estimated q-quantile, 0 <= q <= 1.
+// Return NaN if the sketch is empty.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return math.NaN()
+	}
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zeros {
+		return 0
+	}
+	indices := make([]int, 0, len(s.buckets))
+	for i := range s.buckets {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	seen := s.zeros
+	for _, i := range indices {
+		seen += s.buckets[i]
+		if seen > rank {
+			return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+		}
+	}
+	return 2 * math.Pow(s.gamma, float64(indices[len(indices)-1])) / (s.gamma + 1)
+}
+
+func (s *Sketch) Reset() {
+	clear(s.buckets)
+	s.zeros = 0
+	s.count = 0
+}
@@ -0,0 +1,70 @@
+package quantile
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSketchQuantile(t *testing.T) {
+	const accuracy = 0.01
+	tests := []struct {
+		name   string
+		values []float64
+		q      float64
+		want   float64
+	}{
+		{"single", []float64{0.025}, 0.5, 0.025},
+		{"min", []float64{1, 2, 3, 4, 5}, 0, 1},
+		{"median", []float64{1, 2, 3, 4, 5}, 0.5, 3},
+		{"max", []float64{1, 2, 3, 4, 5}, 1, 5},
+		{"unordered", []float64{5, 1, 4, 2, 3}, 0.5, 3},
+		{"zeros", []float64{0, 0, 0, 1}, 0.5, 0},
+		{"below indexable", []float64{1e-12, 1e-12, 1}, 0.5, 0},
+		{"small and large", []float64{1e-6, 1e3}, 1, 1e3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSketch(accuracy)
+			for _, v := range tt.values {
+				s.Add(v)
+			}
+			if s.Count() != uint64(len(tt.values)) {
+				t.Errorf("Count() = %d, want %d", s.Count(), len(tt.values))
+			}
+			got := s.Quantile(tt.q)
+			if math.Abs(got-tt.want) > tt.want*accuracy {
+				t.Errorf("Quantile(%v) = %v, want %v within %v", tt.q, got, tt.want, accuracy)
+			}
+		})
+	}
+}
+
+func TestSketchRelativeAccuracy(t *testing.T) {
+	const accuracy = 0.01
+	s := NewSketch(accuracy)
+	for i := 1; i <= 1000; i++ {
+		s.Add(float64(i) / 1000)
+	}
+	for _, q := range []float64{0.01, 0.25, 0.5, 0.9, 0.99} {
+		want := float64(int(q*999)+1) / 1000
+		if got := s.Quantile(q); math.Abs(got-want) > want*accuracy {
+			t.Errorf("Quantile(%v) = %v, want %v within %v", q, got, want, accuracy)
+		}
+	}
+}
+
+func TestSketchEmpty(t *testing.T) {
+	s := NewSketch(0.01)
+	if got := s.Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("Quantile(0.5) of an empty sketch = %v, want NaN", got)
+	}
+	s.Add(1)
+	s.Add(0)
+	s.Reset()
+	if s.Count() != 0 {
+		t.Errorf("Count() after Reset() = %d, want 0", s.Count())
+	}
+	if got := s.Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("Quantile(0.5) after Reset() = %v, want NaN", got)
+	}
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"crypto/cipher"
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"log"
 	"net"
-	"strings"
+	"os"
+	"syscall"
 	"time"
 
-	"github.com/m13253/telegraf-better-ping/influxDB_escape"
+	"github.com/m13253/telegraf-better-ping/params"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
@@ -17,68 +18,307 @@ import (
 )
 
 type icmpResponse struct {
-	Comment     string
-	Destination string
+	Duplicate bool
+	// Probe-specific fields, printed after the common ones.
+	Fields      []pointField
 	HasHopLimit bool
+	HasIPDV     bool
+	HasTOS      bool
 	HopLimit    uint8
-	HostTag     string
 	ID          uint16
+	IPDV        time.Duration
+	Jitter      time.Duration
+	Late        bool
+	Params      *params.DestinationParams
 	RecvTime    time.Time
+	RxTimestamp string
+	Reordered   bool
+	ReorderExt  uint64
 	ReplyFrom   net.Addr
 	ReplyTo     net.Addr
 	RTT         time.Duration
 	Seq         uint16
 	Size        int
+	TOS         uint8
+}
+
+// Metadata of a received packet, filled in by readFromIPv4 or readFromIPv6, then by resolveRecvTime.
+type packetInfo struct {
+	// The destination address of the packet, or nil if not available.
+	Dst         net.Addr
+	HasHopLimit bool
+	HasTOS      bool
+	HopLimit    uint8
+	TOS         uint8
+	// Kernel receive timestamps in wall clock time, or zero if not available.
+	HardwareTime time.Time
+	SoftwareTime time.Time
+	// The receive time, made unique by nextUnixTime.
+	RecvTime           time.Time
+	RecvTimeSinceEpoch time.Duration
+	// "hardware" or "software" if a kernel timestamp is used, or "user" if not.
+	TimestampSource string
+}
+
+// Fill in the metadata parsed by ipv4.ControlMessage.
+// A TTL of 0 means it is not available, as such packets are never delivered.
+func (info *packetInfo) setIPv4ControlMessage(cm *ipv4.ControlMessage) {
+	if cm.TTL != 0 {
+		info.HasHopLimit, info.HopLimit = true, uint8(cm.TTL)
+	}
+	if cm.Dst != nil {
+		info.Dst = &net.IPAddr{IP: cm.Dst}
+	}
+}
+
+// Fill in the metadata parsed by ipv6.ControlMessage, except the traffic class,
+// which is 0 both if it is not available and if it is really 0.
+func (info *packetInfo) setIPv6ControlMessage(cm *ipv6.ControlMessage) {
+	if cm.HopLimit != 0 {
+		info.HasHopLimit, info.HopLimit = true, uint8(cm.HopLimit)
+	}
+	if cm.Dst != nil {
+		info.Dst = &net.IPAddr{IP: cm.Dst}
+	}
+}
+
+// Kernel timestamps older than this, or in the future, are assumed to be from an unsynchronized clock.
+const maxTimestampAge = time.Second
+
+// Fill in the time the packet was received, preferring kernel timestamps over the current time,
+// which is delayed by scheduling and garbage collection.
+func (app *appState) resolveRecvTime(info *packetInfo) {
+	now := time.Now()
+	recvTime, source, ok := kernelTime(now, info.HardwareTime, info.SoftwareTime)
+	if !ok {
+		recvTime, source = now, "user"
+	}
+	info.RecvTimeSinceEpoch = recvTime.Sub(app.epoch)
+	info.RecvTime = app.nextUnixTime(recvTime)
+	info.TimestampSource = source
+}
+
+// Convert a kernel timestamp to a time.Time with the monotonic clock reading of now, preferring the hardware one,
+// so it can be compared with other times on the timeline of appState.epoch.
+func kernelTime(now, hardwareTime, softwareTime time.Time) (t time.Time, source string, ok bool) {
+	for _, ts := range [...]struct {
+		Time   time.Time
+		Source string
+	}{{hardwareTime, "hardware"}, {softwareTime, "software"}} {
+		if ts.Time.IsZero() {
+			continue
+		}
+		// The kernel timestamp has no monotonic clock reading, so the age is measured in wall clock time.
+		if age := now.Sub(ts.Time); age >= 0 && age <= maxTimestampAge {
+			return now.Add(-age), ts.Source, true
+		}
+	}
+	return
 }
 
 func (app *appState) startReceivers() {
-	ipv4Conn, err := icmp.ListenPacket("ip4:1", "")
-	if err != nil {
-		log.Fatalf("failed to listen on ICMP protocol: %v\n", err)
+	// Raw sockets only receive packets of their own network namespace, so each namespace has its own receivers.
+	var namespaces []string
+	needICMP := make(map[string]bool)
+	for i := range app.Destinations {
+		if destParams := app.Destinations[i].Params; destParams.Probe == "icmp" || destParams.Probe == "timestamp" || destParams.Trace != 0 || destParams.SweepStep != 0 {
+			if !needICMP[destParams.Netns] {
+				needICMP[destParams.Netns] = true
+				namespaces = append(namespaces, destParams.Netns)
+			}
+		}
+	}
+	for i, netns := range namespaces {
+		var ipv4Conn, ipv6Conn net.PacketConn
+		err := inNetns(netns, func() (err error) {
+			ipv4Conn, err = net.ListenPacket("ip4:1", "")
+			return
+		})
+		if i == 0 && errors.Is(err, os.ErrPermission) {
+			// Replies to datagram sockets are only delivered to the sockets we send from, so each destination has its own receivers.
+			log.Println("raw ICMP sockets are not permitted, using unprivileged ICMP datagram sockets instead")
+			app.icmpDatagram = true
+			return
+		}
+		if err != nil {
+			log.Fatalf("failed to listen on ICMP protocol: %v\n", err)
+		}
+		if i == 0 {
+			log.Println("using raw ICMP sockets")
+		}
+		// Without them, RTTs are measured from the time the packets are read.
+		_ = setRxTimestamp(ipv4Conn.(syscall.Conn))
+		ipv4PacketConn := ipv4.NewPacketConn(ipv4Conn)
+		app.enableIPv4ControlMessages(ipv4PacketConn)
+		err = inNetns(netns, func() (err error) {
+			ipv6Conn, err = net.ListenPacket("ip6:58", "")
+			return
+		})
+		if err != nil {
+			ipv4PacketConn.Close()
+			log.Fatalf("failed to listen on ICMPv6 protocol: %v\n", err)
+		}
+		_ = setRxTimestamp(ipv6Conn.(syscall.Conn))
+		ipv6PacketConn := ipv6.NewPacketConn(ipv6Conn)
+		app.enableIPv6ControlMessages(ipv6PacketConn)
+		go app.startIPv4Receiver(ipv4PacketConn)
+		go app.startIPv6Receiver(ipv6PacketConn)
+	}
+}
+
+// Without control messages, replies are still received, but without some of the fields.
+func (app *appState) enableIPv4ControlMessages(ipv4Conn *ipv4.PacketConn) {
+	app.warnOnce("hop limits and destination addresses of IPv4 replies", ipv4Conn.SetControlMessage(ipv4.FlagTTL|ipv4.FlagDst, true))
+}
+
+func (app *appState) enableIPv6ControlMessages(ipv6Conn *ipv6.PacketConn) {
+	app.warnOnce("hop limits and destination addresses of IPv6 replies", ipv6Conn.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagDst, true))
+	app.warnOnce("traffic classes of IPv6 replies", ipv6Conn.SetControlMessage(ipv6.FlagTrafficClass, true))
+}
+
+// Handle a packet received on a send socket of dest, with the IP header already removed.
+type destPacketHandler func(dest *destinationState, isIPv6 bool, packet []byte, src net.Addr, info *packetInfo)
+
+// Replies to datagram sockets come back to the sockets we send from, so each destination using them has its own receivers.
+// Reads failed by ICMP errors or transmit timestamps queued on the sockets are handled here, other failures are fatal.
+func (app *appState) startDestReceivers(dest *destinationState, name string, ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn, handle destPacketHandler) {
+	if ipv4Conn != nil {
+		app.enableIPv4ControlMessages(ipv4Conn)
+		read := func(b []byte) (int, net.Addr, packetInfo, error) {
+			return readFromIPv4(ipv4Conn, b)
+		}
+		go app.startDestReceiver(dest, name, false, ipv4Conn.PacketConn.(syscall.Conn), read, handle)
 	}
-	ipv4PacketConn := ipv4Conn.IPv4PacketConn()
-	ipv4PacketConn.SetControlMessage(ipv4.FlagTTL, true)
-	ipv4PacketConn.SetControlMessage(ipv4.FlagDst, true)
-	ipv6Conn, err := icmp.ListenPacket("ip6:58", "")
-	if err != nil {
-		ipv4PacketConn.Close()
-		log.Fatalf("failed to listen on ICMPv6 protocol: %v\n", err)
+	if ipv6Conn != nil {
+		app.enableIPv6ControlMessages(ipv6Conn)
+		read := func(b []byte) (int, net.Addr, packetInfo, error) {
+			return readFromIPv6(ipv6Conn, b)
+		}
+		go app.startDestReceiver(dest, name, true, ipv6Conn.PacketConn.(syscall.Conn), read, handle)
+	}
+}
+
+func (app *appState) startDestReceiver(dest *destinationState, name string, isIPv6 bool, conn syscall.Conn, read func(b []byte) (n int, src net.Addr, info packetInfo, err error), handle destPacketHandler) {
+	var buf [65536]byte
+	for {
+		n, src, info, err := read(buf[:])
+		if err != nil {
+			if app.processSocketErrors(dest, conn, err) {
+				continue
+			}
+			log.Fatalf("failed to receive %s message: %v\n", name, err)
+		}
+		app.resolveRecvTime(&info)
+		handle(dest, isIPv6, buf[:n], src, &info)
 	}
-	ipv6PacketConn := ipv6Conn.IPv6PacketConn()
-	ipv6PacketConn.SetControlMessage(ipv6.FlagHopLimit, true)
-	ipv6PacketConn.SetControlMessage(ipv6.FlagDst, true)
-	go app.startIPv4Receiver(ipv4PacketConn)
-	go app.startIPv6Receiver(ipv6PacketConn)
 }
 
 func (app *appState) printResponse(resp *icmpResponse) {
-	rttInt := resp.RTT / 1000000000
-	rttFrac := resp.RTT % 1000000000
-	if rttFrac < 0 {
-		rttFrac = -rttFrac
+	p := &point{Measurement: "ping", Time: resp.RecvTime}
+	p.AddDestinationTags(resp.Params)
+	if resp.Params.IsEcho() {
+		p.AddField("size", uint64(resp.Size))
 	}
-	var sb strings.Builder
-	sb.WriteString("ping,")
-	if len(resp.HostTag) != 0 {
-		sb.WriteString(fmt.Sprintf("host=%s,", influxDB_escape.EscapeKey(resp.HostTag)))
+	p.AddField("reply_from", resp.ReplyFrom.String())
+	if resp.ReplyTo != nil {
+		p.AddField("reply_to", resp.ReplyTo.String())
 	}
-	sb.WriteString(fmt.Sprintf("dest=%s", influxDB_escape.EscapeKey(resp.Destination)))
-	if len(resp.Comment) != 0 {
-		sb.WriteString(fmt.Sprintf(",comment=%s", influxDB_escape.EscapeKey(resp.Comment)))
+	if resp.Params.IsEcho() {
+		p.AddField("icmp_id", uint64(resp.ID))
+		p.AddField("icmp_seq", uint64(resp.Seq))
 	}
-	sb.WriteString(fmt.Sprintf(" size=%du,reply_from=%s,", resp.Size, influxDB_escape.EscapeValue(resp.ReplyFrom.String())))
-	if resp.ReplyTo != nil {
-		sb.WriteString(fmt.Sprintf("reply_to=%s,", influxDB_escape.EscapeValue(resp.ReplyTo.String())))
+	if resp.Duplicate {
+		// The request has already been reported as either delivered or lost.
+	} else if resp.Late {
+		// The request has already been reported as lost, so we don't report it again as delivered.
+		p.AddField("late", true)
+	} else {
+		p.AddField("lost", false)
+	}
+	p.AddField("duplicate", resp.Duplicate)
+	p.AddField("reordered", resp.Reordered)
+	if resp.Reordered {
+		p.AddField("reorder_extent", resp.ReorderExt)
+	}
+	if resp.Params.HasDSCP && resp.HasTOS {
+		// Only meaningful if the remote host copies the DSCP of the request into the reply, as most hosts do for ICMP echo.
+		replyDSCP := resp.TOS >> 2
+		p.AddField("reply_dscp", uint64(replyDSCP))
+		p.AddField("dscp_bleached", replyDSCP == 0 && resp.Params.DSCP != 0)
+		p.AddField("dscp_rewritten", replyDSCP != 0 && replyDSCP != resp.Params.DSCP)
+	}
+	if resp.Params.TTL != 0 {
+		p.AddField("send_hop_limit", uint64(resp.Params.TTL))
 	}
-	sb.WriteString(fmt.Sprintf("icmp_id=%du,icmp_seq=%du,", resp.ID, resp.Seq))
 	if resp.HasHopLimit {
-		sb.WriteString(fmt.Sprintf("hop_limit=%du,", resp.HopLimit))
+		p.AddField("hop_limit", uint64(resp.HopLimit))
+		p.AddField("hops", uint64(estimateHops(resp.HopLimit)))
+	}
+	p.AddField("rtt", resp.RTT)
+	if len(resp.RxTimestamp) != 0 {
+		p.AddField("rx_timestamp", resp.RxTimestamp)
+	}
+	if !resp.Duplicate {
+		p.AddField("jitter", resp.Jitter)
+	}
+	if resp.HasIPDV {
+		p.AddField("ipdv", resp.IPDV)
+	}
+	p.Fields = append(p.Fields, resp.Fields...)
+	app.writePoint(p)
+}
+
+// Estimate the number of hops on the return path,
+// assuming the remote host starts with the smallest common initial TTL that is not less than the received one.
+func estimateHops(hopLimit uint8) uint8 {
+	for _, initial := range [...]uint8{32, 64, 128} {
+		if hopLimit <= initial {
+			return initial - hopLimit
+		}
+	}
+	return 255 - hopLimit
+}
+
+func (app *appState) printLost(req *lostRequest) {
+	p := &point{Measurement: "ping", Time: req.LostTime}
+	p.AddDestinationTags(req.Params)
+	if req.Params.IsEcho() {
+		p.AddField("icmp_id", uint64(req.ID))
+		p.AddField("icmp_seq", uint64(req.Seq))
 	}
-	sb.WriteString(fmt.Sprintf("rtt=%d.%09d %d\n", rttInt, rttFrac, resp.RecvTime.UnixNano()))
-	fmt.Print(sb.String())
+	p.AddField("lost", true)
+	if req.Error != nil {
+		p.AddField("error", req.Error.Name)
+		if req.Error.From != nil {
+			p.AddField("error_from", req.Error.From.String())
+		}
+	}
+	app.writePoint(p)
 }
 
-func (app *appState) processResponse(size int, src, dst net.Addr, recvTimeSinceEpoch time.Duration, recvTime time.Time, hasHopLimit bool, hopLimit uint8, body *icmp.Echo) {
+// Fill in the per-destination statistics of a matched response, then print it.
+func (app *appState) reportResponse(dest *destinationState, resp *icmpResponse) {
+	resp.Duplicate, resp.Reordered, resp.ReorderExt = app.checkArrival(dest, resp.Seq)
+	if !resp.Duplicate {
+		resp.Late = !app.completeRequest(dest, resp.Seq)
+		app.updateJitter(dest, resp)
+	}
+	app.recordReply(dest, resp)
+	app.printResponse(resp)
+}
+
+func (app *appState) processResponse(probe string, size int, src net.Addr, info *packetInfo, body *icmp.Echo) {
+	for i := range app.Destinations {
+		dest := &app.Destinations[i]
+		if dest.Params.Probe != probe || uint16(body.ID) != dest.ID {
+			continue
+		}
+		app.processDestResponse(dest, size, src, info, body)
+	}
+}
+
+// Decrypt and report a response that is known to belong to dest.
+func (app *appState) processDestResponse(dest *destinationState, size int, src net.Addr, info *packetInfo, body *icmp.Echo) {
 	if len(body.Data) < 40 {
 		log.Printf("failed to decode ICMP message from %s: body is less than 40 bytes long", src)
 		return
@@ -93,69 +333,118 @@ func (app *appState) processResponse(size int, src, dst net.Addr, recvTimeSinceE
 	ciphertext := body.Data[16:]
 	buf := make([]byte, 0, len(ciphertext)-chacha20poly1305.Overhead)
 
-	for i := range app.Destinations {
-		dest := &app.Destinations[i]
-		if uint16(body.ID) != dest.ID {
-			continue
-		}
+	for j := 0; j < 2; j++ {
+		if crypt, ok := dest.Cipher[j].Load().(cipher.AEAD); ok {
+			payload, err := crypt.Open(buf[:0], nonce[:], ciphertext, additional)
+			if err != nil {
+				continue
+			}
 
-		for j := 0; j < 2; j++ {
-			if crypt, ok := dest.Cipher[j].Load().(cipher.AEAD); ok {
-				payload, err := crypt.Open(buf[:0], nonce[:], ciphertext, additional)
-				if err != nil {
-					continue
+			sendTimeSinceEpoch := time.Duration(binary.BigEndian.Uint64(payload[:8]))
+			rtt := info.RecvTimeSinceEpoch - sendTimeSinceEpoch
+			var fields []pointField
+			if dest.Params.TxTimestamp {
+				if txTime, source, ok := app.requestTxTime(dest, uint16(body.Seq)); ok {
+					// The time spent in the send call and the qdisc is not a part of the RTT.
+					if sendDelay := txTime.Sub(app.epoch) - sendTimeSinceEpoch; sendDelay >= 0 {
+						rtt -= sendDelay
+						fields = append(fields, pointField{Key: "send_delay", Value: sendDelay}, pointField{Key: "tx_timestamp", Value: source})
+					}
 				}
-
-				sendTimeSinceEpoch := time.Duration(binary.BigEndian.Uint64(payload[:8]))
-				rtt := recvTimeSinceEpoch - sendTimeSinceEpoch
-
-				app.printResponse(&icmpResponse{
-					Comment:     dest.Params.Comment,
-					Destination: dest.Params.Destination,
-					HasHopLimit: hasHopLimit,
-					HopLimit:    hopLimit,
-					HostTag:     dest.Params.HostTag,
-					ID:          uint16(body.ID),
-					RecvTime:    recvTime,
-					ReplyFrom:   src,
-					ReplyTo:     dst,
-					RTT:         rtt,
-					Seq:         uint16(body.Seq),
-					Size:        size,
-				})
 			}
+			series := dest
+			if dest.Params.Multicast != 0 {
+				series = app.responderOf(dest, src, uint16(body.Seq))
+			}
+			app.reportResponse(series, &icmpResponse{
+				Fields:      fields,
+				HasHopLimit: info.HasHopLimit,
+				HasTOS:      info.HasTOS,
+				HopLimit:    info.HopLimit,
+				ID:          uint16(body.ID),
+				Params:      series.Params,
+				RecvTime:    info.RecvTime,
+				RxTimestamp: info.TimestampSource,
+				ReplyFrom:   src,
+				ReplyTo:     info.Dst,
+				RTT:         rtt,
+				Seq:         uint16(body.Seq),
+				Size:        size,
+				TOS:         info.TOS,
+			})
 		}
 	}
 }
 
+// Extract the destination and the transport header from the packet quoted by an ICMP error.
+// At least 8 bytes of the transport header are quoted.
+func parseQuotedPacket(isIPv6 bool, quoted []byte) (proto int, dst net.IP, transport []byte, ok bool) {
+	if isIPv6 {
+		if len(quoted) < 40 {
+			return
+		}
+		proto = int(quoted[6])
+		dst = net.IP(quoted[24:40])
+		transport = quoted[40:]
+	} else {
+		if len(quoted) < 20 {
+			return
+		}
+		ihl := int(quoted[0]&0x0f) * 4
+		if ihl < 20 || len(quoted) < ihl {
+			return
+		}
+		proto = int(quoted[9])
+		dst = net.IP(quoted[16:20])
+		transport = quoted[ihl:]
+	}
+	ok = len(transport) >= 8
+	return
+}
+
 func (app *appState) startIPv4Receiver(ipv4Conn *ipv4.PacketConn) {
 	defer ipv4Conn.Close()
 	var buf [65536]byte
 	for {
-		n, cm, src, err := ipv4Conn.ReadFrom(buf[:])
+		n, src, info, err := readFromIPv4(ipv4Conn, buf[:])
 		if err != nil {
 			log.Fatalf("failed to receive ICMP message: %v\n", err)
 		}
-		recvTime := time.Now()
-		recvTimeSinceEpoch := recvTime.Sub(app.epoch)
-		recvTime = app.nextUnixTime(recvTime)
-		var (
-			hasTTL bool
-			ttl    uint8
-			dst    net.Addr
-		)
-		if cm != nil {
-			hasTTL = true
-			ttl = uint8(cm.TTL)
-			dst = &net.IPAddr{IP: cm.Dst}
-		}
+		app.resolveRecvTime(&info)
+		recvTime := info.RecvTime
 		msg, err := icmp.ParseMessage(1, buf[:n])
 		if err != nil {
 			log.Printf("failed to decode ICMP message from %s: %v\n", src.String(), err)
 			continue
 		}
-		if body, ok := msg.Body.(*icmp.Echo); ok {
-			app.processResponse(n, src, dst, recvTimeSinceEpoch, recvTime, hasTTL, ttl, body)
+		// On loopback, we also receive our own requests, which are skipped.
+		switch msg.Type {
+		case ipv4.ICMPTypeEchoReply:
+			if body, ok := msg.Body.(*icmp.Echo); ok && !app.processHopEchoReply(src, recvTime, body) && !app.processSweepEchoReply(src, recvTime, body) {
+				app.processResponse("icmp", n, src, &info, body)
+			}
+		case ipv4.ICMPTypeTimeExceeded:
+			if body, ok := msg.Body.(*icmp.TimeExceeded); ok {
+				app.processHopError(false, src, recvTime, false, body.Data)
+				app.processProbeError(false, src, recvTime, msg.Type, msg.Code, body.Data)
+			}
+		case ipv4.ICMPTypeDestinationUnreachable:
+			if body, ok := msg.Body.(*icmp.DstUnreach); ok {
+				if msg.Code == 4 {
+					// Fragmentation Needed, with the next-hop MTU in the unused field.
+					app.processSweepTooBig(false, src, recvTime, binary.BigEndian.Uint16(buf[6:8]), body.Data)
+				}
+				app.processHopError(false, src, recvTime, true, body.Data)
+				app.processProbeError(false, src, recvTime, msg.Type, msg.Code, body.Data)
+			}
+		case ipv4.ICMPTypeParameterProblem:
+			if body, ok := msg.Body.(*icmp.ParamProb); ok {
+				app.processProbeError(false, src, recvTime, msg.Type, msg.Code, body.Data)
+			}
+		case ipv4.ICMPTypeTimestampReply:
+			if body, ok := msg.Body.(*icmp.RawBody); ok {
+				app.processTimestampResponse(n, src, &info, body)
+			}
 		}
 	}
 }
@@ -164,30 +453,42 @@ func (app *appState) startIPv6Receiver(ipv6Conn *ipv6.PacketConn) {
 	defer ipv6Conn.Close()
 	var buf [65536]byte
 	for {
-		n, cm, src, err := ipv6Conn.ReadFrom(buf[:])
+		n, src, info, err := readFromIPv6(ipv6Conn, buf[:])
 		if err != nil {
 			log.Fatalf("failed to receive ICMPv6 message: %v\n", err)
 		}
-		recvTime := time.Now()
-		recvTimeSinceEpoch := recvTime.Sub(app.epoch)
-		recvTime = app.nextUnixTime(recvTime)
-		var (
-			hasHopLimit bool
-			hopLimit    uint8
-			dst         net.Addr
-		)
-		if cm != nil {
-			hasHopLimit = true
-			hopLimit = uint8(cm.HopLimit)
-			dst = &net.IPAddr{IP: cm.Dst}
-		}
+		app.resolveRecvTime(&info)
+		recvTime := info.RecvTime
 		msg, err := icmp.ParseMessage(58, buf[:n])
 		if err != nil {
 			log.Printf("failed to decode ICMPv6 message from %s: %v\n", src.String(), err)
 			continue
 		}
-		if body, ok := msg.Body.(*icmp.Echo); ok {
-			app.processResponse(n, src, dst, recvTimeSinceEpoch, recvTime, hasHopLimit, hopLimit, body)
+		// On loopback, we also receive our own requests, which are skipped.
+		switch msg.Type {
+		case ipv6.ICMPTypeEchoReply:
+			if body, ok := msg.Body.(*icmp.Echo); ok && !app.processHopEchoReply(src, recvTime, body) && !app.processSweepEchoReply(src, recvTime, body) {
+				app.processResponse("icmp", n, src, &info, body)
+			}
+		case ipv6.ICMPTypeTimeExceeded:
+			if body, ok := msg.Body.(*icmp.TimeExceeded); ok {
+				app.processHopError(true, src, recvTime, false, body.Data)
+				app.processProbeError(true, src, recvTime, msg.Type, msg.Code, body.Data)
+			}
+		case ipv6.ICMPTypeDestinationUnreachable:
+			if body, ok := msg.Body.(*icmp.DstUnreach); ok {
+				app.processHopError(true, src, recvTime, true, body.Data)
+				app.processProbeError(true, src, recvTime, msg.Type, msg.Code, body.Data)
+			}
+		case ipv6.ICMPTypePacketTooBig:
+			if body, ok := msg.Body.(*icmp.PacketTooBig); ok {
+				app.processSweepTooBig(true, src, recvTime, uint16(min(body.MTU, 65535)), body.Data)
+				app.processProbeError(true, src, recvTime, msg.Type, msg.Code, body.Data)
+			}
+		case ipv6.ICMPTypeParameterProblem:
+			if body, ok := msg.Body.(*icmp.ParamProb); ok {
+				app.processProbeError(true, src, recvTime, msg.Type, msg.Code, body.Data)
+			}
 		}
 	}
 }
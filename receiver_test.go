@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestEstimateHops(t *testing.T) {
+	tests := []struct {
+		hopLimit uint8
+		want     uint8
+	}{
+		{0, 32},
+		{1, 31},
+		{32, 0},
+		{33, 31},
+		{57, 7},
+		{64, 0},
+		{65, 63},
+		{120, 8},
+		{128, 0},
+		{129, 126},
+		{250, 5},
+		{255, 0},
+	}
+	for _, tt := range tests {
+		if got := estimateHops(tt.hopLimit); got != tt.want {
+			t.Errorf("estimateHops(%d) = %d, want %d", tt.hopLimit, got, tt.want)
+		}
+	}
+}
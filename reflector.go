@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"github.com/m13253/telegraf-better-ping/stamp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Run a stateless STAMP Session-Reflector, which copies the sequence number from each test packet.
+// https://www.rfc-editor.org/rfc/rfc8762#section-4.3.1
+func runReflector(params *params.ReflectorParams) {
+	var wg sync.WaitGroup
+	for _, listen := range params.Listen {
+		addr, err := net.ResolveUDPAddr("udp", listen)
+		if err != nil {
+			log.Fatalf("failed to resolve %s: %v\n", listen, err)
+		}
+		if addr.IP.To4() != nil {
+			udpConn, err := net.ListenUDP("udp4", addr)
+			if err != nil {
+				log.Fatalf("failed to listen on %s: %v\n", listen, err)
+			}
+			wg.Add(1)
+			go reflectIPv4(ipv4.NewPacketConn(udpConn), &wg)
+		} else {
+			udpConn, err := net.ListenUDP("udp6", addr)
+			if err != nil {
+				log.Fatalf("failed to listen on %s: %v\n", listen, err)
+			}
+			wg.Add(1)
+			go reflectIPv6(ipv6.NewPacketConn(udpConn), &wg)
+		}
+		fmt.Printf("# STAMP reflector listening on %s.\n", addr)
+	}
+	wg.Wait()
+	os.Exit(1)
+}
+
+func reflectIPv4(ipv4Conn *ipv4.PacketConn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer ipv4Conn.Close()
+	ipv4Conn.SetControlMessage(ipv4.FlagTTL, true)
+	ipv4Conn.SetControlMessage(ipv4.FlagDst, true)
+	var buf [65536]byte
+	for {
+		n, cm, src, err := ipv4Conn.ReadFrom(buf[:])
+		if err != nil {
+			log.Printf("failed to receive STAMP message: %v\n", err)
+			return
+		}
+		recvTime := time.Now()
+		var (
+			ttl uint8
+			wcm *ipv4.ControlMessage
+		)
+		if cm != nil {
+			ttl = uint8(cm.TTL)
+			// Reply from the address the test packet was sent to.
+			wcm = &ipv4.ControlMessage{Src: cm.Dst}
+		}
+		packet, ok := prepareReflectorPacket(buf[:n], src, recvTime, ttl)
+		if !ok {
+			continue
+		}
+		if _, err := ipv4Conn.WriteTo(packet, wcm, src); err != nil {
+			log.Printf("failed to reflect STAMP message to %s: %v\n", src, err)
+		}
+	}
+}
+
+func reflectIPv6(ipv6Conn *ipv6.PacketConn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer ipv6Conn.Close()
+	ipv6Conn.SetControlMessage(ipv6.FlagHopLimit, true)
+	ipv6Conn.SetControlMessage(ipv6.FlagDst, true)
+	var buf [65536]byte
+	for {
+		n, cm, src, err := ipv6Conn.ReadFrom(buf[:])
+		if err != nil {
+			log.Printf("failed to receive STAMP message: %v\n", err)
+			return
+		}
+		recvTime := time.Now()
+		var (
+			hopLimit uint8
+			wcm      *ipv6.ControlMessage
+		)
+		if cm != nil {
+			hopLimit = uint8(cm.HopLimit)
+			// Reply from the address the test packet was sent to.
+			wcm = &ipv6.ControlMessage{Src: cm.Dst}
+		}
+		packet, ok := prepareReflectorPacket(buf[:n], src, recvTime, hopLimit)
+		if !ok {
+			continue
+		}
+		if _, err := ipv6Conn.WriteTo(packet, wcm, src); err != nil {
+			log.Printf("failed to reflect STAMP message to %s: %v\n", src, err)
+		}
+	}
+}
+
+func prepareReflectorPacket(buf []byte, src net.Addr, recvTime time.Time, ttl uint8) (packet []byte, ok bool) {
+	req, err := stamp.ParseSenderPacket(buf)
+	if err != nil {
+		log.Printf("failed to decode STAMP message from %s: %v\n", src, err)
+		return nil, false
+	}
+	reply := stamp.ReflectorPacket{
+		Seq:             req.Seq,
+		Timestamp:       time.Now(),
+		ReceiveTime:     recvTime,
+		SenderSeq:       req.Seq,
+		SenderTimestamp: req.Timestamp,
+		SenderTTL:       ttl,
+	}
+	return reply.Marshal(len(buf)), true
+}
@@ -0,0 +1,58 @@
+package main
+
+// Number of recent arrivals remembered to calculate the reordering extent.
+const reorderHistory = 256
+
+// Protected by destinationState.mtx.
+type arrivalState struct {
+	// Bitmap of sequence numbers that have been replied since they were last sent.
+	Received  [65536 / 64]uint64
+	HasMaxSeq bool
+	MaxSeq    uint16
+	// Ring buffer of recent arrivals.
+	Arrivals     [reorderHistory]uint16
+	ArrivalCount uint64
+}
+
+// Record that a sequence number is sent, clearing its received flag in case it is sent again.
+// The caller must hold destinationState.mtx.
+func (a *arrivalState) sent(seq uint16) {
+	a.Received[seq/64] &^= 1 << (seq % 64)
+	if a.HasMaxSeq && int16(seq-a.MaxSeq) <= 0 {
+		// After no replies for half of the sequence number space, e.g., during a long outage,
+		// MaxSeq would look newer than every new reply, so forget it along with the arrival history.
+		a.HasMaxSeq = false
+		a.ArrivalCount = 0
+	}
+}
+
+// Detect duplicated and reordered replies, according to RFC 4737.
+// If reordered, extent is the number of replies that arrived earlier but carried a greater sequence number.
+// Sequence numbers are compared using serial number arithmetic (RFC 1982).
+func (app *appState) checkArrival(dest *destinationState, seq uint16) (duplicate, reordered bool, extent uint64) {
+	dest.mtx.Lock()
+	defer dest.mtx.Unlock()
+	a := &dest.arrival
+	if a.Received[seq/64]&(1<<(seq%64)) != 0 {
+		duplicate = true
+		return
+	}
+	a.Received[seq/64] |= 1 << (seq % 64)
+
+	if a.HasMaxSeq && int16(seq-a.MaxSeq) < 0 {
+		reordered = true
+		// https://www.rfc-editor.org/rfc/rfc4737#section-4.2
+		for i := a.ArrivalCount - min(a.ArrivalCount, reorderHistory); i < a.ArrivalCount; i++ {
+			if int16(a.Arrivals[i%reorderHistory]-seq) > 0 {
+				extent = a.ArrivalCount - i
+				break
+			}
+		}
+	} else {
+		a.HasMaxSeq = true
+		a.MaxSeq = seq
+	}
+	a.Arrivals[a.ArrivalCount%reorderHistory] = seq
+	a.ArrivalCount++
+	return
+}
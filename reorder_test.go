@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestCheckArrival(t *testing.T) {
+	type arrival struct {
+		seq       uint16
+		duplicate bool
+		reordered bool
+		extent    uint64
+	}
+	tests := []struct {
+		name     string
+		arrivals []arrival
+	}{
+		{"in order", []arrival{{1, false, false, 0}, {2, false, false, 0}, {3, false, false, 0}}},
+		{"duplicate", []arrival{{1, false, false, 0}, {1, true, false, 0}, {2, false, false, 0}}},
+		{"swapped", []arrival{{2, false, false, 0}, {1, false, true, 1}, {3, false, false, 0}}},
+		// RFC 4737, section 4.2.3: the extent counts back to the earliest arrival with a greater sequence number.
+		{"late by three", []arrival{{2, false, false, 0}, {3, false, false, 0}, {4, false, false, 0}, {1, false, true, 3}}},
+		{"late behind smaller", []arrival{{1, false, false, 0}, {3, false, false, 0}, {4, false, false, 0}, {2, false, true, 2}}},
+		{"wraparound", []arrival{{65535, false, false, 0}, {0, false, false, 0}, {65534, false, true, 2}}},
+		{"late duplicate", []arrival{{2, false, false, 0}, {1, false, true, 1}, {1, true, false, 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &appState{}
+			dest := &destinationState{}
+			for i, a := range tt.arrivals {
+				duplicate, reordered, extent := app.checkArrival(dest, a.seq)
+				if duplicate != a.duplicate || reordered != a.reordered || extent != a.extent {
+					t.Errorf("arrival %d: checkArrival(%d) = %v, %v, %d, want %v, %v, %d",
+						i, a.seq, duplicate, reordered, extent, a.duplicate, a.reordered, a.extent)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckArrivalAfterResend(t *testing.T) {
+	app := &appState{}
+	dest := &destinationState{}
+	app.checkArrival(dest, 5)
+	// The sequence number wraps around and is sent again.
+	dest.arrival.sent(5)
+	if duplicate, _, _ := app.checkArrival(dest, 5); duplicate {
+		t.Errorf("checkArrival(5) after sent(5) reported a duplicate")
+	}
+}
+
+func TestCheckArrivalAfterOutage(t *testing.T) {
+	tests := []struct {
+		name string
+		// Number of requests sent without replies after seq 100.
+		outage int
+	}{
+		{"short", 1000},
+		{"half the sequence space", 32768},
+		{"longer than half", 40000},
+		{"whole sequence space", 65536},
+		{"longer than whole", 65536 + 40000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &appState{}
+			dest := &destinationState{}
+			for seq := uint16(98); seq <= 100; seq++ {
+				dest.arrival.sent(seq)
+				app.checkArrival(dest, seq)
+			}
+			seq := uint16(100)
+			for range tt.outage {
+				seq++
+				dest.arrival.sent(seq)
+			}
+			// Replies arrive again, the first two swapped.
+			dest.arrival.sent(seq + 1)
+			dest.arrival.sent(seq + 2)
+			dest.arrival.sent(seq + 3)
+			for i, a := range []struct {
+				seq       uint16
+				reordered bool
+				extent    uint64
+			}{{seq + 2, false, 0}, {seq + 1, true, 1}, {seq + 3, false, 0}} {
+				duplicate, reordered, extent := app.checkArrival(dest, a.seq)
+				if duplicate || reordered != a.reordered || extent != a.extent {
+					t.Errorf("reply %d: checkArrival(%d) = %v, %v, %d, want false, %v, %d",
+						i, a.seq, duplicate, reordered, extent, a.reordered, a.extent)
+				}
+			}
+		})
+	}
+}
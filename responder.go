@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"github.com/m13253/telegraf-better-ping/quantile"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A host replying to a multicast or broadcast destination.
+// Each responder has its own destinationState, so loss and RTT are accounted separately.
+type responder struct {
+	State     *destinationState
+	LastReply time.Time
+}
+
+// Allow sending to broadcast addresses, and set the TTL / hop limit and the interface of multicast packets, if configured.
+func setMulticast(dest *params.DestinationParams, ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn) error {
+	if dest.Multicast == 0 {
+		return nil
+	}
+	var ifi *net.Interface
+	if len(dest.Interface) != 0 {
+		err := inNetns(dest.Netns, func() (err error) {
+			ifi, err = net.InterfaceByName(dest.Interface)
+			return
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set multicast interface for destination %s: %w", dest.Destination, err)
+		}
+	}
+	if ipv4Conn != nil {
+		// Without it, only multicast destinations work.
+		_ = setBroadcast(ipv4Conn.PacketConn.(syscall.Conn))
+		if dest.TTL != 0 {
+			if err := ipv4Conn.SetMulticastTTL(int(dest.TTL)); err != nil {
+				return fmt.Errorf("failed to set multicast TTL for destination %s: %w", dest.Destination, err)
+			}
+		}
+		if ifi != nil {
+			if err := ipv4Conn.SetMulticastInterface(ifi); err != nil {
+				return fmt.Errorf("failed to set multicast interface for destination %s: %w", dest.Destination, err)
+			}
+		}
+	}
+	if ipv6Conn != nil {
+		if dest.TTL != 0 {
+			if err := ipv6Conn.SetMulticastHopLimit(int(dest.TTL)); err != nil {
+				return fmt.Errorf("failed to set multicast hop limit for destination %s: %w", dest.Destination, err)
+			}
+		}
+		if ifi != nil {
+			if err := ipv6Conn.SetMulticastInterface(ifi); err != nil {
+				return fmt.Errorf("failed to set multicast interface for destination %s: %w", dest.Destination, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Return the destinations with their own series: the current responders of a multicast or broadcast destination,
+// or the destination itself.
+func (app *appState) seriesOf(dest *destinationState) []*destinationState {
+	if dest.Params.Multicast == 0 {
+		return []*destinationState{dest}
+	}
+	dest.mtx.Lock()
+	defer dest.mtx.Unlock()
+	series := make([]*destinationState, 0, len(dest.responders))
+	for _, r := range dest.responders {
+		series = append(series, r.State)
+	}
+	return series
+}
+
+// Forget responders that have not replied within the timeout, so their series end instead of reporting losses forever.
+func (app *appState) expireResponders(dest *destinationState) {
+	now := time.Now()
+	var gone []*responder
+	dest.mtx.Lock()
+	for addr, r := range dest.responders {
+		if now.Sub(r.LastReply) > dest.Params.Multicast {
+			delete(dest.responders, addr)
+			gone = append(gone, r)
+		}
+	}
+	dest.mtx.Unlock()
+	for _, r := range gone {
+		// Its requests still in flight are not reported as lost, which stops their timers,
+		// and the current loss burst ends with the responder.
+		r.State.mtx.Lock()
+		clear(r.State.inFlight)
+		ended := r.State.burst.Current
+		r.State.burst.Current = nil
+		r.State.mtx.Unlock()
+		if ended != nil {
+			app.printLossBurst(r.State, ended)
+		}
+		app.printResponder(r.State, false, now.Sub(r.LastReply))
+	}
+}
+
+// Return the address identifying the responder at src.
+// Zones are left out, as their names may be looked up in another network namespace.
+func responderAddr(src net.Addr) string {
+	switch src := src.(type) {
+	case *net.IPAddr:
+		return src.IP.String()
+	case *net.UDPAddr:
+		return src.IP.String()
+	default:
+		return src.String()
+	}
+}
+
+// Return the series waiting for the request that an ICMP error from src fails, or nil if there is none.
+// Errors for a multicast or broadcast destination only belong to a series if they come from a known responder,
+// as hosts do not send errors for such requests, and an error from a router says nothing about the other responders.
+func (app *appState) errorSeriesOf(dest *destinationState, src net.Addr) *destinationState {
+	if dest.Params.Multicast == 0 {
+		return dest
+	}
+	if src == nil {
+		return nil
+	}
+	dest.mtx.Lock()
+	defer dest.mtx.Unlock()
+	if r, ok := dest.responders[responderAddr(src)]; ok {
+		return r.State
+	}
+	return nil
+}
+
+// Return the responder replying from src, which starts waiting for seq if it is new.
+func (app *appState) responderOf(dest *destinationState, src net.Addr, seq uint16) *destinationState {
+	addr := responderAddr(src)
+	dest.mtx.Lock()
+	r, ok := dest.responders[addr]
+	if ok {
+		r.LastReply = time.Now()
+		dest.mtx.Unlock()
+		return r.State
+	}
+	destParams := *dest.Params
+	destParams.Multicast = 0
+	destParams.Responder = addr
+	r = &responder{
+		State: &destinationState{
+			Params:   &destParams,
+			ID:       dest.ID,
+			inFlight: make(map[uint16]inFlightRequest),
+		},
+		LastReply: time.Now(),
+	}
+	if destParams.SummaryWindow > 0 {
+		r.State.summary.RTTs = quantile.NewSketch(summaryQuantileAccuracy)
+	}
+	if dest.responders == nil {
+		dest.responders = make(map[string]*responder)
+	}
+	dest.responders[addr] = r
+	dest.mtx.Unlock()
+
+	// The request was sent before we knew the responder.
+	app.trackRequest(r.State, seq)
+	app.recordSent(r.State)
+	app.printResponder(r.State, true, 0)
+	return r.State
+}
+
+func (app *appState) printResponder(dest *destinationState, present bool, idle time.Duration) {
+	p := &point{Measurement: "ping_responder", Time: app.nextUnixTime(time.Now())}
+	p.AddDestinationTags(dest.Params)
+	p.AddField("present", present)
+	if !present {
+		p.AddField("idle", idle)
+	}
+	app.writePoint(p)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestProcessSocketErrorMulticast(t *testing.T) {
+	responderIP := net.IPv4(192, 0, 2, 2)
+	tests := []struct {
+		name     string
+		offender net.IP
+		lost     bool
+	}{
+		{"from responder", responderIP, true},
+		{"from router", net.IPv4(192, 0, 2, 1), false},
+		{"unknown offender", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, dest, output := newTestApp(t, params.DestinationParams{
+				Destination: "224.0.0.1",
+				Multicast:   10 * time.Second,
+				Port:        7,
+				Probe:       "udp",
+				Protocol:    "ip4",
+				Size:        56,
+			})
+			const seq = 1
+			r := app.responderOf(dest, &net.UDPAddr{IP: responderIP, Port: 7}, seq)
+			if p := nextPoint(t, output); p["measurement"] != "ping_responder" {
+				t.Fatalf("got %v, want a ping_responder point", p)
+			}
+
+			app.processSocketError(dest, time.Now(), &sockError{
+				Offender: tt.offender,
+				Payload:  marshalUDPEcho(&icmp.Echo{ID: int(dest.ID), Seq: seq}),
+				Type:     ipv4.ICMPTypeDestinationUnreachable,
+				Code:     3,
+			})
+			r.mtx.Lock()
+			_, inFlight := r.inFlight[seq]
+			r.mtx.Unlock()
+			if inFlight == tt.lost {
+				t.Errorf("request still in flight = %v, want %v", inFlight, !tt.lost)
+			}
+			if !tt.lost {
+				return
+			}
+			p := nextPoint(t, output)
+			if p["responder"] != responderIP.String() || p["lost"] != true || p["error"] != "destination unreachable: port unreachable" {
+				t.Errorf("got %v, want a loss of responder %s with the error", p, responderIP)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
@@ -30,17 +31,50 @@ func (app *appState) startSenders() {
 }
 
 func (app *appState) startSender(dest *destinationState, wg *sync.WaitGroup) {
-	ipv4Conn, ipv6Conn, err := app.createSendConn(dest.Params)
-	if ipv4Conn != nil {
-		defer ipv4Conn.Close()
-	}
-	if ipv6Conn != nil {
-		defer ipv6Conn.Close()
+	var (
+		ipv4Conn *ipv4.PacketConn
+		ipv6Conn *ipv6.PacketConn
+		err      error
+	)
+	if dest.Params.IsEcho() || dest.Params.Probe == "stamp" || dest.Params.Probe == "timestamp" {
+		if dest.Params.Probe == "icmp" && app.icmpDatagram {
+			ipv4Conn, ipv6Conn, err = app.createPingConn(dest)
+		} else {
+			ipv4Conn, ipv6Conn, err = app.createSendConn(dest.Params)
+		}
+		if ipv4Conn != nil {
+			defer ipv4Conn.Close()
+		}
+		if ipv6Conn != nil {
+			defer ipv6Conn.Close()
+		}
+		if err == nil {
+			err = setHopLimit(dest.Params, ipv4Conn, ipv6Conn)
+		}
+		if err == nil {
+			err = setDSCP(dest.Params, ipv4Conn, ipv6Conn)
+		}
+		if err == nil {
+			err = setTxTimestamps(dest, ipv4Conn, ipv6Conn)
+		}
+		if err == nil {
+			err = setMulticast(dest.Params, ipv4Conn, ipv6Conn)
+		}
+		if err != nil {
+			log.Println(err)
+			wg.Done()
+			return
+		}
 	}
-	if err != nil {
-		log.Println(err)
-		wg.Done()
-		return
+	switch dest.Params.Probe {
+	case "icmp":
+		if app.icmpDatagram {
+			app.startDestReceivers(dest, "ICMP", ipv4Conn, ipv6Conn, app.processPingPacket)
+		}
+	case "stamp":
+		app.startDestReceivers(dest, "STAMP", ipv4Conn, ipv6Conn, app.processSTAMPPacket)
+	case "udp":
+		app.startDestReceivers(dest, "UDP", ipv4Conn, ipv6Conn, app.processUDPPacket)
 	}
 
 	delay, err := app.rng.Duration(dest.Params.Interval)
@@ -52,7 +86,14 @@ func (app *appState) startSender(dest *destinationState, wg *sync.WaitGroup) {
 		log.Fatalf("failed to initialize destination %s: %v\n", dest.Params.Destination, err)
 	}
 
-	fmt.Printf("# PING %s with %d bytes of data, will start in %.3f seconds at sequence number %d.\n", strings.ReplaceAll(dest.Params.Destination, "\n", "\n# "), dest.Params.Size, delay.Seconds(), seq)
+	if dest.Params.Trace != 0 {
+		go app.startTracer(dest)
+	}
+	if dest.Params.SweepStep != 0 {
+		go app.startSweeper(dest)
+	}
+
+	app.printSessionStart(dest, delay, seq)
 	time.Sleep(delay)
 	var (
 		count uint16
@@ -77,9 +118,37 @@ out:
 		// https://go.dev/ref/spec#Integer_overflow
 		count++
 
+		if dest.Params.TxTimestamp {
+			// Keep the socket error queue short, even if no replies arrive.
+			app.collectTxTimestamps(dest)
+		}
+
+		if dest.Params.Probe == "http" {
+			// Name resolution is a part of the measurement.
+			app.trackRequest(dest, seq)
+			go app.sendHTTPProbe(dest, seq)
+			seq++
+			continue
+		}
+
 		addrs, err := net.LookupHost(dest.Params.Destination)
 		if err != nil {
 			log.Printf("failed to lookup %s: %v\n", dest.Params.Destination, err)
+			// Report the request of this interval as lost, so DNS outages still count as loss.
+			app.trackRequest(dest, seq)
+			app.recordSent(dest)
+			app.failRequest(dest, seq, app.nextUnixTime(time.Now()), &icmpError{Name: "name resolution failed"})
+			seq++
+			continue
+		}
+		app.trackRequest(dest, seq)
+		switch dest.Params.Probe {
+		case "dns":
+			go app.sendDNSProbe(dest, seq, addrs)
+			seq++
+			continue
+		case "tcp":
+			go app.sendTCPProbe(dest, seq, addrs)
 			seq++
 			continue
 		}
@@ -88,8 +157,9 @@ out:
 			ipv4Packet, ipv6Packet := app.prepareRequestBody(dest, seq, crypt)
 			if ipv6Conn != nil {
 				if ipv6Addr, err := net.ResolveIPAddr("ip6", addr); err == nil {
-					_, err = ipv6Conn.WriteTo(ipv6Packet, nil, ipv6Addr)
+					_, err = ipv6Conn.WriteTo(ipv6Packet, nil, app.remoteAddr(dest.Params, ipv6Addr))
 					if err == nil {
+						app.recordSent(dest)
 						seq++
 						continue out
 					}
@@ -98,8 +168,9 @@ out:
 			}
 			if ipv4Conn != nil {
 				if ipv4Addr, err := net.ResolveIPAddr("ip4", addr); err == nil {
-					_, err = ipv4Conn.WriteTo(ipv4Packet, nil, ipv4Addr)
+					_, err = ipv4Conn.WriteTo(ipv4Packet, nil, app.remoteAddr(dest.Params, ipv4Addr))
 					if err == nil {
+						app.recordSent(dest)
 						seq++
 						continue out
 					}
@@ -107,6 +178,7 @@ out:
 				}
 			}
 		}
+		app.untrackRequest(dest, seq)
 		if firstErr != nil {
 			log.Printf("failed to ping %s: %v\n", dest.Params.Destination, firstErr)
 		} else {
@@ -116,7 +188,40 @@ out:
 	}
 }
 
+func (app *appState) printSessionStart(dest *destinationState, delay time.Duration, seq uint16) {
+	if app.Params.OutputFormat != "json" {
+		if dest.Params.IsEcho() {
+			fmt.Printf("# PING %s with %d bytes of data, will start in %.3f seconds at sequence number %d.\n", strings.ReplaceAll(dest.Params.Destination, "\n", "\n# "), dest.Params.Size, delay.Seconds(), seq)
+		} else {
+			fmt.Printf("# PING %s using %s probes, will start in %.3f seconds.\n", strings.ReplaceAll(dest.Params.Destination, "\n", "\n# "), dest.Params.Probe, delay.Seconds())
+		}
+		return
+	}
+	p := &point{Measurement: "ping_session_start", Time: time.Now()}
+	p.AddDestinationTags(dest.Params)
+	if dest.Params.IsEcho() {
+		p.AddField("size", uint64(dest.Params.Size))
+	}
+	p.AddField("start_delay", delay)
+	if dest.Params.IsEcho() {
+		p.AddField("icmp_id", uint64(dest.ID))
+		p.AddField("icmp_seq", uint64(seq))
+	}
+	app.writePoint(p)
+}
+
 func (app *appState) prepareRequestBody(dest *destinationState, seq uint16, crypt cipher.AEAD) (ipv4Packet, ipv6Packet []byte) {
+	switch dest.Params.Probe {
+	case "stamp":
+		ipv4Packet = marshalSTAMPRequest(seq)
+		ipv6Packet = ipv4Packet
+		return
+	case "timestamp":
+		// There is no ICMPv6 equivalent.
+		ipv4Packet = marshalTimestampRequest(dest, seq)
+		return
+	}
+
 	sendTime := time.Now()
 	sendTimeSinceEpoch := sendTime.Sub(app.epoch)
 	unixTimeSec := sendTime.Unix()
@@ -145,6 +250,11 @@ func (app *appState) prepareRequestBody(dest *destinationState, seq uint16, cryp
 		Seq:  int(seq),
 		Data: data,
 	}
+	if dest.Params.Probe == "udp" {
+		ipv4Packet = marshalUDPEcho(&body)
+		ipv6Packet = ipv4Packet
+		return
+	}
 
 	ipv4Packet, err := (&icmp.Message{
 		Type: ipv4.ICMPTypeEcho,
@@ -165,33 +275,135 @@ func (app *appState) prepareRequestBody(dest *destinationState, seq uint16, cryp
 }
 
 func (app *appState) createSendConn(dest *params.DestinationParams) (ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn, err error) {
+	listenIPv4, listenIPv6 := listenICMPv4, listenICMPv6
+	switch dest.Probe {
+	case "stamp", "udp":
+		listenIPv4, listenIPv6 = app.listenUDPSendv4, app.listenUDPSendv6
+	case "timestamp":
+		ipv4Conn, err = listenIPv4(dest)
+		return
+	}
 	switch dest.Protocol {
 	case "ip":
-		icmpConn, ipv4Err := icmp.ListenPacket("ip4:1", dest.Source)
-		if ipv4Err == nil {
-			ipv4Conn = icmpConn.IPv4PacketConn()
-		}
-		icmpv6Conn, ipv6Err := icmp.ListenPacket("ip6:58", dest.Source)
-		if ipv6Err == nil {
-			ipv6Conn = icmpv6Conn.IPv6PacketConn()
-		}
+		var ipv4Err, ipv6Err error
+		ipv4Conn, ipv4Err = listenIPv4(dest)
+		ipv6Conn, ipv6Err = listenIPv6(dest)
 		if ipv4Err != nil && ipv6Err != nil {
 			err = fmt.Errorf("failed to create socket for destination %s: %w", dest.Destination, ipv4Err)
 		}
 	case "ip4":
-		icmpConn, ipv4Err := icmp.ListenPacket("ip4:1", dest.Source)
-		if ipv4Err == nil {
-			ipv4Conn = icmpConn.IPv4PacketConn()
-		}
-		err = ipv4Err
+		ipv4Conn, err = listenIPv4(dest)
 	case "ip6":
-		icmpv6Conn, ipv6Err := icmp.ListenPacket("ip6:58", dest.Source)
-		if ipv6Err == nil {
-			ipv6Conn = icmpv6Conn.IPv6PacketConn()
-		}
-		err = ipv6Err
+		ipv6Conn, err = listenIPv6(dest)
 	default:
 		panic(fmt.Sprintf("unknown protocol: %q", dest.Protocol))
 	}
 	return
 }
+
+// Set the TTL / hop limit of sent packets, if configured.
+func setHopLimit(dest *params.DestinationParams, ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn) error {
+	if dest.TTL == 0 {
+		return nil
+	}
+	if ipv4Conn != nil {
+		if err := ipv4Conn.SetTTL(int(dest.TTL)); err != nil {
+			return fmt.Errorf("failed to set TTL for destination %s: %w", dest.Destination, err)
+		}
+	}
+	if ipv6Conn != nil {
+		if err := ipv6Conn.SetHopLimit(int(dest.TTL)); err != nil {
+			return fmt.Errorf("failed to set hop limit for destination %s: %w", dest.Destination, err)
+		}
+	}
+	return nil
+}
+
+// Set the DSCP of sent packets, if configured. The ECN bits are left zero.
+func setDSCP(dest *params.DestinationParams, ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn) error {
+	if !dest.HasDSCP {
+		return nil
+	}
+	if ipv4Conn != nil {
+		if err := ipv4Conn.SetTOS(int(dest.DSCP) << 2); err != nil {
+			return fmt.Errorf("failed to set TOS for destination %s: %w", dest.Destination, err)
+		}
+	}
+	if ipv6Conn != nil {
+		if err := ipv6Conn.SetTrafficClass(int(dest.DSCP) << 2); err != nil {
+			return fmt.Errorf("failed to set traffic class for destination %s: %w", dest.Destination, err)
+		}
+	}
+	return nil
+}
+
+func listenICMPv4(dest *params.DestinationParams) (*ipv4.PacketConn, error) {
+	conn, err := listenPacket(dest, "ip4:1", dest.Source)
+	if err != nil {
+		return nil, err
+	}
+	return ipv4.NewPacketConn(conn), nil
+}
+
+func listenICMPv6(dest *params.DestinationParams) (*ipv6.PacketConn, error) {
+	conn, err := listenPacket(dest, "ip6:58", dest.Source)
+	if err != nil {
+		return nil, err
+	}
+	return ipv6.NewPacketConn(conn), nil
+}
+
+// Open a socket for dest, inside its network namespace, bound to its interface, and with its firewall mark, if configured.
+func listenPacket(dest *params.DestinationParams, network, address string) (conn net.PacketConn, err error) {
+	err = inNetns(dest.Netns, func() error {
+		lc := net.ListenConfig{Control: controlSocket(dest)}
+		conn, err = lc.ListenPacket(context.Background(), network, address)
+		return err
+	})
+	return
+}
+
+// Same as dialer.DialContext, but inside the network namespace of dest, bound to its interface, and with its firewall mark, if configured.
+func dialContext(ctx context.Context, dest *params.DestinationParams, dialer *net.Dialer, network, address string) (conn net.Conn, err error) {
+	dialer.Control = controlSocket(dest)
+	if len(dest.Netns) != 0 {
+		// Racing IPv4 and IPv6 would dial from other goroutines, outside the namespace.
+		dialer.FallbackDelay = -1
+	}
+	err = inNetns(dest.Netns, func() error {
+		conn, err = dialer.DialContext(ctx, network, address)
+		return err
+	})
+	return
+}
+
+// Pick the first address matching the protocol preference.
+func pickAddr(dest *params.DestinationParams, addrs []string) *net.IPAddr {
+	if dest.Protocol != "ip4" {
+		for _, addr := range addrs {
+			if ipv6Addr, err := net.ResolveIPAddr("ip6", addr); err == nil {
+				return ipv6Addr
+			}
+		}
+	}
+	if dest.Protocol != "ip6" {
+		for _, addr := range addrs {
+			if ipv4Addr, err := net.ResolveIPAddr("ip4", addr); err == nil {
+				return ipv4Addr
+			}
+		}
+	}
+	return nil
+}
+
+// Return the address to send packets to, according to the probe type.
+func (app *appState) remoteAddr(dest *params.DestinationParams, addr *net.IPAddr) net.Addr {
+	if dest.Probe == "stamp" || dest.Probe == "udp" {
+		return &net.UDPAddr{IP: addr.IP, Port: int(dest.Port), Zone: addr.Zone}
+	}
+	if dest.Probe == "icmp" && app.icmpDatagram {
+		// Datagram sockets take UDP addresses, the port is ignored.
+		return &net.UDPAddr{IP: addr.IP, Zone: addr.Zone}
+	}
+	return addr
+}
@@ -0,0 +1,314 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+func setSockopt(conn syscall.Conn, set func(fd int) error) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = set(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Set the DF bit on IPv4, and forbid fragmentation on IPv6.
+// Packets larger than the cached path MTU are still sent, so we can probe beyond it.
+func setDontFragment(conn syscall.Conn, isIPv6 bool) error {
+	return setSockopt(conn, func(fd int) error {
+		if isIPv6 {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE); err != nil {
+				return err
+			}
+			return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1)
+		}
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+	})
+}
+
+// Queue ICMP errors of the packets we send on the socket error queue, to be read by readErrQueue.
+// Reading from the socket fails once for each error.
+func setRecvErr(conn syscall.Conn, isIPv6 bool) error {
+	return setSockopt(conn, func(fd int) error {
+		if isIPv6 {
+			return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1)
+		}
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVERR, 1)
+	})
+}
+
+// Parse struct sock_extended_err, followed by the address of the sender of the ICMP error.
+func parseSockExtendedErr(cmsg *unix.SocketControlMessage, payload []byte) (sockErr sockError, ok bool) {
+	const sizeofSockExtendedErr = 16
+	data := cmsg.Data
+	if len(data) < sizeofSockExtendedErr {
+		return
+	}
+	origin, typ, code := data[4], data[5], data[6]
+	switch {
+	case cmsg.Header.Level == unix.IPPROTO_IP && cmsg.Header.Type == unix.IP_RECVERR && origin == unix.SO_EE_ORIGIN_ICMP:
+		sockErr.Type = ipv4.ICMPType(typ)
+		if len(data) >= sizeofSockExtendedErr+unix.SizeofSockaddrInet4 && binary.NativeEndian.Uint16(data[16:18]) == unix.AF_INET {
+			sockErr.Offender = net.IP(bytes.Clone(data[20:24]))
+		}
+	case cmsg.Header.Level == unix.IPPROTO_IPV6 && cmsg.Header.Type == unix.IPV6_RECVERR && origin == unix.SO_EE_ORIGIN_ICMP6:
+		sockErr.Type = ipv6.ICMPType(typ)
+		if len(data) >= sizeofSockExtendedErr+unix.SizeofSockaddrInet6 && binary.NativeEndian.Uint16(data[16:18]) == unix.AF_INET6 {
+			sockErr.Offender = net.IP(bytes.Clone(data[24:40]))
+		}
+	default:
+		// Local errors, e.g., EMSGSIZE, are already reported by the send call.
+		return
+	}
+	sockErr.Code = int(code)
+	sockErr.Payload = bytes.Clone(payload)
+	return sockErr, true
+}
+
+// Allow sending to IPv4 broadcast addresses.
+func setBroadcast(conn syscall.Conn) error {
+	return setSockopt(conn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+	})
+}
+
+// Receive the TOS byte of IPv4 packets as a control message, to be read by readFromIPv4.
+func setRecvTOS(conn syscall.Conn) error {
+	return setSockopt(conn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+	})
+}
+
+// Receive kernel timestamps of packets as control messages, to be read by readFromIPv4 and readFromIPv6.
+// Hardware timestamps are only available if enabled on the network interface, e.g., by a PTP daemon.
+func setRxTimestamp(conn syscall.Conn) error {
+	return setSockopt(conn, func(fd int) error {
+		flags := unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE | unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags); err == nil {
+			return nil
+		}
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+	})
+}
+
+// Same as ipv4.PacketConn.ReadFrom, but return the control message as packetInfo, along with the TOS byte and the kernel timestamps.
+// The TOS byte is taken from the IPv4 header on raw sockets, or from the control message enabled by setRecvTOS on datagram sockets.
+func readFromIPv4(conn *ipv4.PacketConn, b []byte) (n int, src net.Addr, info packetInfo, err error) {
+	var h [ipv4.HeaderLen]byte
+	_, isRaw := conn.LocalAddr().(*net.IPAddr)
+	ms := []ipv4.Message{{OOB: make([]byte, 256)}}
+	if isRaw {
+		ms[0].Buffers = [][]byte{h[:], b}
+	} else {
+		ms[0].Buffers = [][]byte{b}
+	}
+	if _, err = conn.ReadBatch(ms, 0); err != nil {
+		return
+	}
+	m := &ms[0]
+	n, src = m.N, m.Addr
+	if isRaw {
+		hdrLen := int(h[0]&0x0f) << 2
+		if hdrLen > len(h) {
+			d := hdrLen - len(h)
+			copy(b, b[d:])
+			n -= d
+		} else {
+			n -= hdrLen
+		}
+		info.HasTOS, info.TOS = true, h[1]
+	}
+	if m.NN > 0 {
+		var cm ipv4.ControlMessage
+		if err = cm.Parse(m.OOB[:m.NN]); err != nil {
+			return
+		}
+		info.setIPv4ControlMessage(&cm)
+		cmsgs, _ := unix.ParseSocketControlMessage(m.OOB[:m.NN])
+		for _, cmsg := range cmsgs {
+			if cmsg.Header.Level == unix.IPPROTO_IP && cmsg.Header.Type == unix.IP_TOS && len(cmsg.Data) >= 1 {
+				info.HasTOS, info.TOS = true, cmsg.Data[0]
+			}
+		}
+		parseTimestamps(&info, cmsgs)
+	}
+	return
+}
+
+// Same as ipv6.PacketConn.ReadFrom, but return the control message as packetInfo, along with the kernel timestamps.
+func readFromIPv6(conn *ipv6.PacketConn, b []byte) (n int, src net.Addr, info packetInfo, err error) {
+	ms := []ipv6.Message{{Buffers: [][]byte{b}, OOB: make([]byte, 256)}}
+	if _, err = conn.ReadBatch(ms, 0); err != nil {
+		return
+	}
+	m := &ms[0]
+	n, src = m.N, m.Addr
+	if m.NN > 0 {
+		var cm ipv6.ControlMessage
+		if err = cm.Parse(m.OOB[:m.NN]); err != nil {
+			return
+		}
+		info.setIPv6ControlMessage(&cm)
+		cmsgs, _ := unix.ParseSocketControlMessage(m.OOB[:m.NN])
+		for _, cmsg := range cmsgs {
+			if cmsg.Header.Level == unix.IPPROTO_IPV6 && cmsg.Header.Type == unix.IPV6_TCLASS {
+				info.HasTOS, info.TOS = true, uint8(cm.TrafficClass)
+			}
+		}
+		parseTimestamps(&info, cmsgs)
+	}
+	return
+}
+
+// Also report kernel timestamps of sent packets on the socket error queue, to be read by readErrQueue.
+// Packets are looped back with the timestamps, so they can be matched with the requests.
+func setTxTimestamp(conn syscall.Conn) error {
+	return setSockopt(conn, func(fd int) error {
+		// Keep the receive timestamps enabled by setRxTimestamp.
+		flags, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING)
+		if err != nil {
+			flags = 0
+		}
+		flags |= unix.SOF_TIMESTAMPING_TX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE | unix.SOF_TIMESTAMPING_TX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags)
+	})
+}
+
+// Read all ICMP errors and transmit timestamps from the socket error queue, without waiting.
+// n is the number of messages read, including those that are neither.
+// The receiver may be waiting on the same socket, so the socket is read directly instead of through ReadBatch,
+// which also fails on transmit timestamps, as they have no source address.
+func readErrQueue(conn syscall.Conn) (errs []sockError, stamps []txTimestamp, n int, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 65536)
+	oob := make([]byte, 512)
+	var recvErr error
+	err = rawConn.Control(func(fd uintptr) {
+		for {
+			msgLen, oobn, _, _, err := unix.Recvmsg(int(fd), buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err != nil {
+				if !errors.Is(err, unix.EAGAIN) {
+					recvErr = os.NewSyscallError("recvmsg", err)
+				}
+				return
+			}
+			n++
+			cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				recvErr = err
+				return
+			}
+			var (
+				isStamp bool
+				info    packetInfo
+			)
+			for _, cmsg := range cmsgs {
+				if sockErr, ok := parseSockExtendedErr(&cmsg, buf[:msgLen]); ok {
+					errs = append(errs, sockErr)
+				} else if (cmsg.Header.Level == unix.IPPROTO_IP && cmsg.Header.Type == unix.IP_RECVERR || cmsg.Header.Level == unix.IPPROTO_IPV6 && cmsg.Header.Type == unix.IPV6_RECVERR) && len(cmsg.Data) >= 5 && cmsg.Data[4] == unix.SO_EE_ORIGIN_TIMESTAMPING {
+					isStamp = true
+				}
+			}
+			if isStamp {
+				parseTimestamps(&info, cmsgs)
+				stamps = append(stamps, txTimestamp{
+					HardwareTime: info.HardwareTime,
+					SoftwareTime: info.SoftwareTime,
+					Packet:       bytes.Clone(buf[:msgLen]),
+				})
+			}
+		}
+	})
+	if err == nil {
+		err = recvErr
+	}
+	return
+}
+
+const sizeofTimespec = int(unsafe.Sizeof(unix.Timespec{}))
+
+// SCM_TIMESTAMPING carries three timestamps: software, deprecated, and raw hardware. Unavailable ones are zero.
+// The same control message carries both receive and transmit timestamps.
+func parseTimestamps(info *packetInfo, cmsgs []unix.SocketControlMessage) {
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level != unix.SOL_SOCKET {
+			continue
+		}
+		switch cmsg.Header.Type {
+		case unix.SCM_TIMESTAMPING:
+			if len(cmsg.Data) >= 3*sizeofTimespec {
+				ts := (*[3]unix.Timespec)(unsafe.Pointer(&cmsg.Data[0]))
+				info.SoftwareTime = timespecTime(ts[0])
+				info.HardwareTime = timespecTime(ts[2])
+			}
+		case unix.SCM_TIMESTAMPNS:
+			if len(cmsg.Data) >= sizeofTimespec {
+				ts := (*unix.Timespec)(unsafe.Pointer(&cmsg.Data[0]))
+				info.SoftwareTime = timespecTime(*ts)
+			}
+		}
+	}
+}
+
+func timespecTime(ts unix.Timespec) time.Time {
+	if ts.Sec == 0 && ts.Nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts.Unix())
+}
+
+// Return a function for net.ListenConfig.Control and net.Dialer.Control, which binds the socket to a network interface or VRF,
+// and sets its firewall mark, if configured.
+func controlSocket(dest *params.DestinationParams) func(network, address string, c syscall.RawConn) error {
+	if len(dest.Interface) == 0 && !dest.HasMark {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = setDeviceAndMark(int(fd), dest)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+func setDeviceAndMark(fd int, dest *params.DestinationParams) error {
+	if len(dest.Interface) != 0 {
+		if err := unix.BindToDevice(fd, dest.Interface); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if dest.HasMark {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(dest.Mark)); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
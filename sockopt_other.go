@@ -0,0 +1,67 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func setDontFragment(conn syscall.Conn, isIPv6 bool) error {
+	return errors.ErrUnsupported
+}
+
+func setRecvErr(conn syscall.Conn, isIPv6 bool) error {
+	return errors.ErrUnsupported
+}
+
+func readErrQueue(conn syscall.Conn) (errs []sockError, stamps []txTimestamp, n int, err error) {
+	return nil, nil, 0, errors.ErrUnsupported
+}
+
+func setBroadcast(conn syscall.Conn) error {
+	return errors.ErrUnsupported
+}
+
+func setRecvTOS(conn syscall.Conn) error {
+	return errors.ErrUnsupported
+}
+
+func setRxTimestamp(conn syscall.Conn) error {
+	return errors.ErrUnsupported
+}
+
+func setTxTimestamp(conn syscall.Conn) error {
+	return errors.ErrUnsupported
+}
+
+func readFromIPv4(conn *ipv4.PacketConn, b []byte) (n int, src net.Addr, info packetInfo, err error) {
+	n, cm, src, err := conn.ReadFrom(b)
+	if cm != nil {
+		info.setIPv4ControlMessage(cm)
+	}
+	return
+}
+
+// Without the raw control messages, we cannot tell whether the traffic class is available, so it is not reported.
+func readFromIPv6(conn *ipv6.PacketConn, b []byte) (n int, src net.Addr, info packetInfo, err error) {
+	n, cm, src, err := conn.ReadFrom(b)
+	if cm != nil {
+		info.setIPv6ControlMessage(cm)
+	}
+	return
+}
+
+func controlSocket(dest *params.DestinationParams) func(network, address string, c syscall.RawConn) error {
+	if len(dest.Interface) == 0 && !dest.HasMark {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.ErrUnsupported
+	}
+}
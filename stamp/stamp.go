@@ -0,0 +1,138 @@
+package stamp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Simple Two-Way Active Measurement Protocol, unauthenticated mode.
+// https://www.rfc-editor.org/rfc/rfc8762
+
+// Both Session-Sender and Session-Reflector test packets are 44 bytes long in unauthenticated mode.
+const PacketLen = 44
+
+// Estimated error of our timestamps: 1 × 2^(22-32) seconds ≈ 1 millisecond, clock not synchronized to UTC.
+// https://www.rfc-editor.org/rfc/rfc4656#section-4.1.2
+const errorEstimate = 22<<8 | 1
+
+type SenderPacket struct {
+	Seq       uint32
+	Timestamp time.Time
+}
+
+type ReflectorPacket struct {
+	Seq             uint32
+	Timestamp       time.Time
+	ReceiveTime     time.Time
+	SenderSeq       uint32
+	SenderTimestamp time.Time
+	SenderTTL       uint8
+}
+
+var ErrShortPacket = errors.New("STAMP packet is shorter than 44 bytes")
+
+// Marshal a Session-Sender test packet:
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                        Sequence Number                        |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                          Timestamp                            |
+//	|                                                               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|         Error Estimate        |                               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+                               +
+//	|                         MBZ (30 octets)                       |
+func (p *SenderPacket) Marshal() []byte {
+	buf := make([]byte, PacketLen)
+	binary.BigEndian.PutUint32(buf[0:4], p.Seq)
+	binary.BigEndian.PutUint64(buf[4:12], ToNTP(p.Timestamp))
+	binary.BigEndian.PutUint16(buf[12:14], errorEstimate)
+	return buf
+}
+
+func ParseSenderPacket(buf []byte) (p *SenderPacket, err error) {
+	if len(buf) < PacketLen {
+		return nil, ErrShortPacket
+	}
+	return &SenderPacket{
+		Seq:       binary.BigEndian.Uint32(buf[0:4]),
+		Timestamp: FromNTP(binary.BigEndian.Uint64(buf[4:12])),
+	}, nil
+}
+
+// Marshal a Session-Reflector test packet:
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                        Sequence Number                        |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                          Timestamp                            |
+//	|                                                               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|         Error Estimate        |           MBZ                 |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                          Receive Timestamp                    |
+//	|                                                               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                 Session-Sender Sequence Number                |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                  Session-Sender Timestamp                     |
+//	|                                                               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	| Session-Sender Error Estimate |           MBZ                 |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|Ses-Sender TTL |                   MBZ                         |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// The packet is padded to length, so the reflected packet is as long as the sender packet.
+func (p *ReflectorPacket) Marshal(length int) []byte {
+	buf := make([]byte, max(length, PacketLen))
+	binary.BigEndian.PutUint32(buf[0:4], p.Seq)
+	binary.BigEndian.PutUint64(buf[4:12], ToNTP(p.Timestamp))
+	binary.BigEndian.PutUint16(buf[12:14], errorEstimate)
+	binary.BigEndian.PutUint64(buf[16:24], ToNTP(p.ReceiveTime))
+	binary.BigEndian.PutUint32(buf[24:28], p.SenderSeq)
+	binary.BigEndian.PutUint64(buf[28:36], ToNTP(p.SenderTimestamp))
+	binary.BigEndian.PutUint16(buf[36:38], errorEstimate)
+	buf[40] = p.SenderTTL
+	return buf
+}
+
+func ParseReflectorPacket(buf []byte) (p *ReflectorPacket, err error) {
+	if len(buf) < PacketLen {
+		return nil, ErrShortPacket
+	}
+	return &ReflectorPacket{
+		Seq:             binary.BigEndian.Uint32(buf[0:4]),
+		Timestamp:       FromNTP(binary.BigEndian.Uint64(buf[4:12])),
+		ReceiveTime:     FromNTP(binary.BigEndian.Uint64(buf[16:24])),
+		SenderSeq:       binary.BigEndian.Uint32(buf[24:28]),
+		SenderTimestamp: FromNTP(binary.BigEndian.Uint64(buf[28:36])),
+		SenderTTL:       buf[40],
+	}, nil
+}
+
+// Seconds between 1900-01-01 (NTP epoch) and 1970-01-01 (Unix epoch).
+const ntpEpochOffset = 2208988800
+
+// Convert to the 64-bit NTP timestamp format, 32 bits of seconds and 32 bits of fraction.
+func ToNTP(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond()) << 32) / 1000000000
+	return sec<<32 | frac
+}
+
+// Convert from the 64-bit NTP timestamp format, assuming era 0 (years 1900 to 2036) or era 1 (years 2036 to 2172).
+func FromNTP(ntp uint64) time.Time {
+	sec := int64(ntp >> 32)
+	if sec < 1<<31 {
+		// After 2036-02-07, wrapped around.
+		sec += 1 << 32
+	}
+	nsec := int64(((ntp & 0xffffffff) * 1000000000) >> 32)
+	return time.Unix(sec-ntpEpochOffset, nsec)
+}
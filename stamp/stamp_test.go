@@ -0,0 +1,89 @@
+package stamp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNTP(t *testing.T) {
+	tests := []struct {
+		name string
+		time time.Time
+		ntp  uint64
+	}{
+		{"unix epoch", time.Unix(0, 0), ntpEpochOffset << 32},
+		{"half second", time.Unix(0, 500000000), ntpEpochOffset<<32 | 1<<31},
+		{"2000", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), 3155673600 << 32},
+		{"last second of era 0", time.Date(2036, 2, 7, 6, 28, 15, 0, time.UTC), 0xffffffff << 32},
+		{"start of era 1", time.Date(2036, 2, 7, 6, 28, 16, 0, time.UTC), 0},
+		{"era 1", time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), 2016466304 << 32},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ToNTP(tt.time); got != tt.ntp {
+				t.Errorf("ToNTP(%v) = %#x, want %#x", tt.time, got, tt.ntp)
+			}
+			if got := FromNTP(tt.ntp); !got.Equal(tt.time) {
+				t.Errorf("FromNTP(%#x) = %v, want %v", tt.ntp, got, tt.time)
+			}
+		})
+	}
+}
+
+func TestNTPRoundTrip(t *testing.T) {
+	// The fraction has a resolution of about 233 picoseconds, so a round trip loses at most 1 ns.
+	for _, nsec := range []int{0, 1, 999999999, 123456789, 500000001} {
+		want := time.Date(2026, 10, 18, 12, 34, 56, nsec, time.UTC)
+		got := FromNTP(ToNTP(want))
+		if d := want.Sub(got); d < 0 || d > time.Nanosecond {
+			t.Errorf("FromNTP(ToNTP(%v)) = %v, off by %v", want, got, d)
+		}
+	}
+}
+
+func TestPackets(t *testing.T) {
+	// Whole seconds survive the NTP conversion exactly.
+	base := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	sender := &SenderPacket{Seq: 7, Timestamp: base}
+	buf := sender.Marshal()
+	if len(buf) != PacketLen {
+		t.Errorf("len(Marshal()) = %d, want %d", len(buf), PacketLen)
+	}
+	gotSender, err := ParseSenderPacket(buf)
+	if err != nil {
+		t.Fatalf("ParseSenderPacket() failed: %v", err)
+	}
+	if gotSender.Seq != sender.Seq || !gotSender.Timestamp.Equal(sender.Timestamp) {
+		t.Errorf("ParseSenderPacket() = %+v, want %+v", gotSender, sender)
+	}
+
+	reflector := &ReflectorPacket{
+		Seq:             8,
+		Timestamp:       base.Add(3 * time.Second),
+		ReceiveTime:     base.Add(2 * time.Second),
+		SenderSeq:       7,
+		SenderTimestamp: base,
+		SenderTTL:       64,
+	}
+	buf = reflector.Marshal(PacketLen + 16)
+	if len(buf) != PacketLen+16 {
+		t.Errorf("len(Marshal(%d)) = %d", PacketLen+16, len(buf))
+	}
+	gotReflector, err := ParseReflectorPacket(buf)
+	if err != nil {
+		t.Fatalf("ParseReflectorPacket() failed: %v", err)
+	}
+	if gotReflector.Seq != reflector.Seq || !gotReflector.Timestamp.Equal(reflector.Timestamp) ||
+		!gotReflector.ReceiveTime.Equal(reflector.ReceiveTime) || gotReflector.SenderSeq != reflector.SenderSeq ||
+		!gotReflector.SenderTimestamp.Equal(reflector.SenderTimestamp) || gotReflector.SenderTTL != reflector.SenderTTL {
+		t.Errorf("ParseReflectorPacket() = %+v, want %+v", gotReflector, reflector)
+	}
+
+	if _, err := ParseSenderPacket(make([]byte, PacketLen-1)); !errors.Is(err, ErrShortPacket) {
+		t.Errorf("ParseSenderPacket() of a short packet returned %v, want %v", err, ErrShortPacket)
+	}
+	if _, err := ParseReflectorPacket(make([]byte, PacketLen-1)); !errors.Is(err, ErrShortPacket) {
+		t.Errorf("ParseReflectorPacket() of a short packet returned %v, want %v", err, ErrShortPacket)
+	}
+}
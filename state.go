@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/m13253/telegraf-better-ping/csprng"
@@ -13,14 +16,36 @@ type appState struct {
 	Params       *params.PingParams
 	Destinations []destinationState
 	epoch        time.Time
+	// Whether to use unprivileged ICMP datagram sockets instead of raw sockets.
+	icmpDatagram bool
 	lastNow      atomic.Int64
+	output       lineWriter
 	rng          csprng.CSPRNG
+	// Optional features that failed to be enabled, to be logged only once.
+	warned sync.Map
 }
 
 type destinationState struct {
 	Params *params.DestinationParams
 	ID     uint16
 	Cipher [2]atomic.Value
+
+	mtx      sync.Mutex
+	inFlight map[uint16]inFlightRequest
+	nextGen  uint64
+	metrics  destinationMetrics
+	summary  windowSummary
+	jitter   jitterState
+	arrival  arrivalState
+	burst    burstState
+	trace    traceState
+	sweep    sweepState
+	// Send sockets with transmit timestamps enabled.
+	txConns []syscall.Conn
+	// ICMP errors drained from txConns by collectTxTimestamps, each of which still fails a read of the receiver.
+	drainedErrors int
+	// Responders of a multicast or broadcast destination, by address.
+	responders map[string]*responder
 }
 
 func NewApp(params *params.PingParams) (app *appState, err error) {
@@ -28,10 +53,18 @@ func NewApp(params *params.PingParams) (app *appState, err error) {
 		Params:       params,
 		Destinations: make([]destinationState, 0, len(params.Destinations)),
 		epoch:        time.Now(),
+		output:       stdoutWriter{},
+	}
+	if len(params.InfluxURL) != 0 {
+		app.output, err = newInfluxDBWriter(params)
+		if err != nil {
+			return
+		}
 	}
 	for i := range params.Destinations {
 		app.Destinations = append(app.Destinations, destinationState{
-			Params: &params.Destinations[i],
+			Params:   &params.Destinations[i],
+			inFlight: make(map[uint16]inFlightRequest),
 		})
 		dest := &app.Destinations[i]
 		dest.ID, err = app.rng.UInt16()
@@ -59,3 +92,14 @@ func (app *appState) nextUnixTime(now time.Time) time.Time {
 		}
 	}
 }
+
+// Log a failure to enable an optional feature of a socket, once for each feature,
+// as it usually fails the same way on every socket.
+func (app *appState) warnOnce(feature string, err error) {
+	if err == nil {
+		return
+	}
+	if _, loaded := app.warned.LoadOrStore(feature, struct{}{}); !loaded {
+		log.Printf("failed to enable %s: %v\n", feature, err)
+	}
+}
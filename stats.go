@@ -0,0 +1,68 @@
+package main
+
+func (app *appState) recordSent(dest *destinationState) {
+	if dest.Params.Multicast != 0 {
+		for _, r := range app.seriesOf(dest) {
+			app.recordSent(r)
+		}
+		return
+	}
+	dest.mtx.Lock()
+	dest.metrics.Sent++
+	dest.summary.Sent++
+	dest.mtx.Unlock()
+}
+
+func (app *appState) recordLost(dest *destinationState) {
+	dest.mtx.Lock()
+	dest.metrics.Lost++
+	dest.summary.Lost++
+	dest.mtx.Unlock()
+}
+
+func (app *appState) recordLossBurst(dest *destinationState, burst *lossBurst) {
+	dest.mtx.Lock()
+	dest.metrics.LossBursts++
+	dest.summary.Bursts++
+	dest.summary.BurstLength += burst.Length
+	dest.mtx.Unlock()
+}
+
+func (app *appState) recordReply(dest *destinationState, resp *icmpResponse) {
+	dest.mtx.Lock()
+	defer dest.mtx.Unlock()
+	m := &dest.metrics
+	if resp.Reordered {
+		m.Reordered++
+		dest.summary.Reordered++
+	}
+	if resp.Duplicate {
+		// Duplicated replies are not counted as delivered.
+		m.Duplicates++
+		dest.summary.Duplicates++
+		return
+	}
+	if resp.Late {
+		m.Late++
+	} else {
+		m.Received++
+	}
+	m.HasRTT = true
+	m.LastRTT = resp.RTT
+	if resp.HasHopLimit {
+		m.HasHopLimit = true
+		m.HopLimit = resp.HopLimit
+	}
+	for i, bound := range rttBuckets {
+		if resp.RTT.Seconds() <= bound {
+			m.RTTBuckets[i]++
+		}
+	}
+	m.RTTCount++
+	m.RTTSum += resp.RTT
+
+	if !resp.Late {
+		dest.summary.Received++
+		dest.summary.addRTT(resp.RTT)
+	}
+}
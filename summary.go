@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/quantile"
+)
+
+// Relative error of the RTT percentiles.
+const summaryQuantileAccuracy = 0.005
+
+// Statistics within the current summary window.
+// Protected by destinationState.mtx.
+type windowSummary struct {
+	Sent       uint64
+	Received   uint64
+	Lost       uint64
+	Duplicates uint64
+	Reordered  uint64
+	// Loss bursts that have ended within the window.
+	Bursts      uint64
+	BurstLength uint64
+	RTTCount    uint64
+	RTTMin      time.Duration
+	RTTMax      time.Duration
+	// Welford's online algorithm, in seconds.
+	RTTMean float64
+	RTTM2   float64
+	RTTs    *quantile.Sketch
+}
+
+func (s *windowSummary) addRTT(rtt time.Duration) {
+	if s.RTTs == nil {
+		// Summary is disabled for this destination.
+		return
+	}
+	if s.RTTCount == 0 || rtt < s.RTTMin {
+		s.RTTMin = rtt
+	}
+	if s.RTTCount == 0 || rtt > s.RTTMax {
+		s.RTTMax = rtt
+	}
+	s.RTTCount++
+	x := rtt.Seconds()
+	delta := x - s.RTTMean
+	s.RTTMean += delta / float64(s.RTTCount)
+	s.RTTM2 += delta * (x - s.RTTMean)
+	s.RTTs.Add(x)
+}
+
+func (app *appState) startSummaries() {
+	for i := range app.Destinations {
+		dest := &app.Destinations[i]
+		if dest.Params.SummaryWindow > 0 {
+			dest.summary.RTTs = quantile.NewSketch(summaryQuantileAccuracy)
+			go app.startSummary(dest)
+		}
+	}
+}
+
+func (app *appState) startSummary(dest *destinationState) {
+	ticker := time.NewTicker(dest.Params.SummaryWindow)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, series := range app.seriesOf(dest) {
+			app.printSummary(series)
+		}
+	}
+}
+
+func (app *appState) printSummary(dest *destinationState) {
+	dest.mtx.Lock()
+	p := &point{Measurement: "ping_summary", Time: app.nextUnixTime(time.Now())}
+	p.AddDestinationTags(dest.Params)
+	dest.summary.addFields(p, dest.Params.SummaryWindow)
+	sketch := dest.summary.RTTs
+	sketch.Reset()
+	dest.summary = windowSummary{RTTs: sketch}
+	dest.mtx.Unlock()
+	app.writePoint(p)
+}
+
+func (s *windowSummary) addFields(p *point, window time.Duration) {
+	p.AddField("window", window)
+	p.AddField("sent", s.Sent)
+	p.AddField("received", s.Received)
+	p.AddField("lost", s.Lost)
+	p.AddField("duplicates", s.Duplicates)
+	p.AddField("reordered", s.Reordered)
+	if s.Received+s.Lost != 0 {
+		p.AddField("loss", float64(s.Lost)/float64(s.Received+s.Lost))
+	}
+	p.AddField("loss_bursts", s.Bursts)
+	if s.Bursts != 0 {
+		meanBurstLength := float64(s.BurstLength) / float64(s.Bursts)
+		p.AddField("mean_burst_length", meanBurstLength)
+		// Parameters of the simple Gilbert model (Gilbert-Elliott model with k = 1, h = 0):
+		// p is the probability of going from the good state to the bad state, r is the reverse.
+		if s.Received != 0 {
+			p.AddField("gilbert_p", min(float64(s.Bursts)/float64(s.Received), 1))
+		}
+		p.AddField("gilbert_r", 1/meanBurstLength)
+	}
+	if s.RTTCount != 0 {
+		p.AddField("rtt_min", s.RTTMin)
+		p.AddField("rtt_mean", s.RTTMean)
+		p.AddField("rtt_max", s.RTTMax)
+		p.AddField("rtt_stddev", math.Sqrt(s.RTTM2/float64(s.RTTCount)))
+		p.AddField("rtt_p50", s.RTTs.Quantile(0.5))
+		p.AddField("rtt_p90", s.RTTs.Quantile(0.9))
+		p.AddField("rtt_p99", s.RTTs.Quantile(0.99))
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Protected by destinationState.mtx.
+type sweepState struct {
+	ID      uint16
+	NextSeq uint16
+	NextGen uint64
+	Probes  map[uint16]sweepProbe
+}
+
+type sweepProbe struct {
+	Cycle    *sweepCycle
+	Gen      uint64
+	SendTime time.Time
+	Size     uint16
+	// Length of the IP and ICMP headers.
+	Overhead uint16
+}
+
+// Results of sweeping through all sizes once.
+// Protected by destinationState.mtx.
+type sweepCycle struct {
+	Sent        uint64
+	Received    uint64
+	TooBig      uint64
+	MaxSize     uint16
+	PathMTU     uint32
+	ReportedMTU uint16
+}
+
+// Send ICMP echo requests with the DF bit set, with a different payload size each interval.
+// Each reply, or ICMP Fragmentation Needed / Packet Too Big, is printed as a "ping_sweep" measurement,
+// and after each pass through all sizes, the largest size that got through is printed as a "ping_pmtu" measurement.
+func (app *appState) startSweeper(dest *destinationState) {
+	var (
+		ipv4Conn *ipv4.PacketConn
+		ipv6Conn *ipv6.PacketConn
+		err      error
+	)
+	id, err := app.rng.UInt16()
+	if err != nil {
+		log.Fatalf("failed to initialize destination %s: %v\n", dest.Params.Destination, err)
+	}
+	ipv4Conn, ipv6Conn, err = listenConns(dest, listenSweepICMPv4, listenSweepICMPv6)
+	if err != nil {
+		log.Printf("failed to start sweeping %s: %v\n", dest.Params.Destination, err)
+		return
+	}
+	if ipv4Conn != nil {
+		defer ipv4Conn.Close()
+	}
+	if ipv6Conn != nil {
+		defer ipv6Conn.Close()
+	}
+
+	dest.mtx.Lock()
+	dest.sweep.ID = id
+	dest.sweep.Probes = make(map[uint16]sweepProbe)
+	dest.mtx.Unlock()
+
+	delay, err := app.rng.Duration(dest.Params.Interval)
+	if err != nil {
+		log.Fatalf("failed to initialize destination %s: %v\n", dest.Params.Destination, err)
+	}
+	time.Sleep(delay)
+	ticker := time.NewTicker(dest.Params.Interval)
+	defer ticker.Stop()
+
+	var cycle *sweepCycle
+	size := dest.Params.SweepMin
+	for ; ; <-ticker.C {
+		if size == dest.Params.SweepMin {
+			cycle = new(sweepCycle)
+		}
+		app.sendSweepProbe(dest, cycle, size, ipv4Conn, ipv6Conn)
+		if uint32(size)+uint32(dest.Params.SweepStep) > uint32(dest.Params.SweepMax) {
+			// Wait for the last replies of this cycle.
+			lastCycle := cycle
+			time.AfterFunc(dest.Params.Timeout, func() {
+				app.printSweepCycle(dest, lastCycle)
+			})
+			size = dest.Params.SweepMin
+		} else {
+			size += dest.Params.SweepStep
+		}
+	}
+}
+
+func listenSweepICMPv4(dest *params.DestinationParams) (*ipv4.PacketConn, error) {
+	conn, err := listenPacket(dest, "ip4:1", dest.Source)
+	if err != nil {
+		return nil, err
+	}
+	if err := setDontFragment(conn.(syscall.Conn), false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ipv4.NewPacketConn(conn), nil
+}
+
+func listenSweepICMPv6(dest *params.DestinationParams) (*ipv6.PacketConn, error) {
+	conn, err := listenPacket(dest, "ip6:58", dest.Source)
+	if err != nil {
+		return nil, err
+	}
+	if err := setDontFragment(conn.(syscall.Conn), true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ipv6.NewPacketConn(conn), nil
+}
+
+func (app *appState) sendSweepProbe(dest *destinationState, cycle *sweepCycle, size uint16, ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn) {
+	addrs, err := net.LookupHost(dest.Params.Destination)
+	if err != nil {
+		log.Printf("failed to lookup %s: %v\n", dest.Params.Destination, err)
+		return
+	}
+	addr := pickAddr(dest.Params, addrs)
+	if addr == nil || (addr.IP.To4() != nil && ipv4Conn == nil) || (addr.IP.To4() == nil && ipv6Conn == nil) {
+		log.Printf("failed to sweep %s: no available address\n", dest.Params.Destination)
+		return
+	}
+	isIPv4 := addr.IP.To4() != nil
+
+	var (
+		typ      icmp.Type = ipv6.ICMPTypeEchoRequest
+		overhead uint16    = 40 + 8
+	)
+	if isIPv4 {
+		typ, overhead = ipv4.ICMPTypeEcho, 20+8
+	}
+	dest.mtx.Lock()
+	seq := dest.sweep.NextSeq
+	dest.sweep.NextSeq++
+	dest.sweep.NextGen++
+	gen := dest.sweep.NextGen
+	id := dest.sweep.ID
+	cycle.Sent++
+	dest.sweep.Probes[seq] = sweepProbe{
+		Cycle:    cycle,
+		Gen:      gen,
+		SendTime: time.Now(),
+		Size:     size,
+		Overhead: overhead,
+	}
+	dest.mtx.Unlock()
+
+	packet, err := (&icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: int(id), Seq: int(seq), Data: make([]byte, size)},
+	}).Marshal(nil)
+	if err != nil {
+		panic(err)
+	}
+	if isIPv4 {
+		_, err = ipv4Conn.WriteTo(packet, nil, addr)
+	} else {
+		_, err = ipv6Conn.WriteTo(packet, nil, addr)
+	}
+	if errors.Is(err, syscall.EMSGSIZE) {
+		// Larger than the MTU of our own interface.
+		app.completeSweep(dest, seq, nil, time.Now(), true, 0)
+		return
+	}
+	if err != nil {
+		dest.mtx.Lock()
+		delete(dest.sweep.Probes, seq)
+		cycle.Sent--
+		dest.mtx.Unlock()
+		log.Printf("failed to sweep %s: %v\n", dest.Params.Destination, err)
+		return
+	}
+
+	time.AfterFunc(dest.Params.Timeout, func() {
+		dest.mtx.Lock()
+		probe, ok := dest.sweep.Probes[seq]
+		if !ok || probe.Gen != gen {
+			dest.mtx.Unlock()
+			return
+		}
+		delete(dest.sweep.Probes, seq)
+		dest.mtx.Unlock()
+
+		p := &point{Measurement: "ping_sweep", Time: app.nextUnixTime(time.Now())}
+		p.AddDestinationTags(dest.Params)
+		p.AddField("size", uint64(probe.Size))
+		p.AddField("lost", true)
+		app.writePoint(p)
+	})
+}
+
+// Stop waiting for a sweep probe, then print the reply or the ICMP error.
+func (app *appState) completeSweep(dest *destinationState, seq uint16, src net.Addr, recvTime time.Time, tooBig bool, mtu uint16) (matched bool) {
+	dest.mtx.Lock()
+	probe, ok := dest.sweep.Probes[seq]
+	if !ok {
+		dest.mtx.Unlock()
+		return false
+	}
+	delete(dest.sweep.Probes, seq)
+	cycle := probe.Cycle
+	if tooBig {
+		cycle.TooBig++
+		if mtu != 0 && (cycle.ReportedMTU == 0 || mtu < cycle.ReportedMTU) {
+			cycle.ReportedMTU = mtu
+		}
+	} else {
+		cycle.Received++
+		if probe.Size >= cycle.MaxSize {
+			cycle.MaxSize = probe.Size
+			cycle.PathMTU = uint32(probe.Size) + uint32(probe.Overhead)
+		}
+	}
+	dest.mtx.Unlock()
+
+	p := &point{Measurement: "ping_sweep", Time: app.nextUnixTime(recvTime)}
+	p.AddDestinationTags(dest.Params)
+	p.AddField("size", uint64(probe.Size))
+	if src != nil {
+		p.AddField("reply_from", src.String())
+	}
+	if tooBig {
+		p.AddField("lost", true)
+		p.AddField("too_big", true)
+		if mtu != 0 {
+			p.AddField("mtu", uint64(mtu))
+		}
+	} else {
+		p.AddField("lost", false)
+		p.AddField("rtt", recvTime.Sub(probe.SendTime))
+	}
+	app.writePoint(p)
+	return true
+}
+
+func (app *appState) printSweepCycle(dest *destinationState, cycle *sweepCycle) {
+	dest.mtx.Lock()
+	c := *cycle
+	dest.mtx.Unlock()
+
+	p := &point{Measurement: "ping_pmtu", Time: app.nextUnixTime(time.Now())}
+	p.AddDestinationTags(dest.Params)
+	p.AddField("sent", c.Sent)
+	p.AddField("received", c.Received)
+	p.AddField("too_big", c.TooBig)
+	if c.Received != 0 {
+		p.AddField("max_size", uint64(c.MaxSize))
+		p.AddField("path_mtu", uint64(c.PathMTU))
+	}
+	if c.ReportedMTU != 0 {
+		p.AddField("reported_mtu", uint64(c.ReportedMTU))
+	}
+	app.writePoint(p)
+}
+
+// Match an ICMP echo reply against sweep probes.
+// Return true if it belongs to a sweep, so it is not an echo reply of normal probes.
+func (app *appState) processSweepEchoReply(src net.Addr, recvTime time.Time, body *icmp.Echo) (matched bool) {
+	for i := range app.Destinations {
+		dest := &app.Destinations[i]
+		if dest.Params.SweepStep == 0 {
+			continue
+		}
+		dest.mtx.Lock()
+		id := dest.sweep.ID
+		dest.mtx.Unlock()
+		if uint16(body.ID) == id && app.completeSweep(dest, uint16(body.Seq), src, recvTime, false, 0) {
+			matched = true
+		}
+	}
+	return
+}
+
+// Match an ICMP Fragmentation Needed or Packet Too Big message against sweep probes by the echo request it quotes.
+func (app *appState) processSweepTooBig(isIPv6 bool, src net.Addr, recvTime time.Time, mtu uint16, quoted []byte) {
+	proto, _, transport, ok := parseQuotedPacket(isIPv6, quoted)
+	if !ok {
+		return
+	}
+	if isIPv6 && (proto != 58 || transport[0] != byte(ipv6.ICMPTypeEchoRequest)) || !isIPv6 && (proto != 1 || transport[0] != byte(ipv4.ICMPTypeEcho)) {
+		return
+	}
+	id := binary.BigEndian.Uint16(transport[4:6])
+	seq := binary.BigEndian.Uint16(transport[6:8])
+	for i := range app.Destinations {
+		dest := &app.Destinations[i]
+		if dest.Params.SweepStep == 0 {
+			continue
+		}
+		dest.mtx.Lock()
+		match := dest.sweep.ID == id
+		dest.mtx.Unlock()
+		if match {
+			app.completeSweep(dest, seq, src, recvTime, true, mtu)
+		}
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Protected by destinationState.mtx.
+type traceState struct {
+	// The ICMP identifier, or the TCP source port, shared by all probes of the destination.
+	ID uint16
+	// The UDP source ports of the IPv4 and IPv6 sockets.
+	UDPPort4 uint16
+	UDPPort6 uint16
+	// Stop sending probes beyond the hop where the destination has replied.
+	Limit   uint8
+	NextSeq uint16
+	NextGen uint64
+	Probes  map[uint16]hopProbe
+}
+
+type hopProbe struct {
+	Addr     net.IP
+	Gen      uint64
+	SendTime time.Time
+	TTL      uint8
+}
+
+// A trace probe identified from a reply, or from the packet quoted in an ICMP error.
+type hopReply struct {
+	Addr      net.IP
+	RecvTime  time.Time
+	ReplyFrom net.IP
+	Reached   bool
+	Seq       uint16
+	// If nonzero and Seq matches no probe of this TTL, match the oldest probe of this TTL instead.
+	TTL uint8
+}
+
+// Send probes with increasing TTL / hop limit to the destination every interval, like MTR.
+//
+// All probes of a destination belong to the same flow, so routers doing ECMP send them along the same path, like Paris traceroute:
+//   - ICMP probes keep the same identifier and checksum, and carry a compensation word after the sequence number.
+//   - UDP probes keep the same ports, and carry a compensation word so the checksum equals the sequence number.
+//   - TCP SYN probes keep the same ports, and carry the sequence number in the TCP sequence number.
+func (app *appState) startTracer(dest *destinationState) {
+	if app.icmpDatagram {
+		// Time Exceeded errors from routers only arrive at the raw ICMP receivers, so every hop would be reported as lost.
+		log.Printf("failed to start tracing %s: raw ICMP sockets are not permitted\n", dest.Params.Destination)
+		return
+	}
+	var (
+		ipv4Conn *ipv4.PacketConn
+		ipv6Conn *ipv6.PacketConn
+		err      error
+	)
+	id, err := app.rng.UInt16()
+	if err != nil {
+		log.Fatalf("failed to initialize destination %s: %v\n", dest.Params.Destination, err)
+	}
+	if dest.Params.Probe == "tcp" {
+		// Pick a source port from the dynamic range, so it does not collide with services.
+		id = 49152 + id%16384
+	}
+	switch dest.Params.Probe {
+	case "icmp":
+		ipv4Conn, ipv6Conn, err = listenConns(dest, listenICMPv4, listenICMPv6)
+	case "tcp":
+		ipv4Conn, ipv6Conn, err = listenConns(dest, listenRawTCPv4, listenRawTCPv6)
+	case "udp":
+		ipv4Conn, ipv6Conn, err = listenConns(dest, listenUDPv4, listenUDPv6)
+	default:
+		panic(fmt.Sprintf("unsupported probe for tracing: %q", dest.Params.Probe))
+	}
+	if err != nil {
+		log.Printf("failed to start tracing %s: %v\n", dest.Params.Destination, err)
+		return
+	}
+	if ipv4Conn != nil {
+		defer ipv4Conn.Close()
+	}
+	if ipv6Conn != nil {
+		defer ipv6Conn.Close()
+	}
+
+	dest.mtx.Lock()
+	dest.trace.ID = id
+	dest.trace.Limit = dest.Params.Trace
+	dest.trace.Probes = make(map[uint16]hopProbe)
+	switch dest.Params.Probe {
+	case "tcp":
+		app.startTraceTCPReceivers(dest, ipv4Conn, ipv6Conn)
+	case "udp":
+		if ipv4Conn != nil {
+			dest.trace.UDPPort4 = uint16(ipv4Conn.LocalAddr().(*net.UDPAddr).Port)
+		}
+		if ipv6Conn != nil {
+			dest.trace.UDPPort6 = uint16(ipv6Conn.LocalAddr().(*net.UDPAddr).Port)
+		}
+		app.startTraceUDPReceivers(dest, ipv4Conn, ipv6Conn)
+	}
+	dest.mtx.Unlock()
+
+	delay, err := app.rng.Duration(dest.Params.Interval)
+	if err != nil {
+		log.Fatalf("failed to initialize destination %s: %v\n", dest.Params.Destination, err)
+	}
+	time.Sleep(delay)
+	ticker := time.NewTicker(dest.Params.Interval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		addrs, err := net.LookupHost(dest.Params.Destination)
+		if err != nil {
+			log.Printf("failed to lookup %s: %v\n", dest.Params.Destination, err)
+			continue
+		}
+		addr := pickAddr(dest.Params, addrs)
+		if addr == nil || (addr.IP.To4() != nil && ipv4Conn == nil) || (addr.IP.To4() == nil && ipv6Conn == nil) {
+			log.Printf("failed to trace %s: no available address\n", dest.Params.Destination)
+			continue
+		}
+		if err := app.sendTraceRound(dest, addr, ipv4Conn, ipv6Conn); err != nil {
+			log.Printf("failed to trace %s: %v\n", dest.Params.Destination, err)
+		}
+	}
+}
+
+func listenConns(dest *destinationState, listenIPv4 func(*params.DestinationParams) (*ipv4.PacketConn, error), listenIPv6 func(*params.DestinationParams) (*ipv6.PacketConn, error)) (ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn, err error) {
+	switch dest.Params.Protocol {
+	case "ip":
+		var ipv4Err, ipv6Err error
+		ipv4Conn, ipv4Err = listenIPv4(dest.Params)
+		ipv6Conn, ipv6Err = listenIPv6(dest.Params)
+		if ipv4Err != nil && ipv6Err != nil {
+			err = ipv4Err
+		}
+	case "ip4":
+		ipv4Conn, err = listenIPv4(dest.Params)
+	case "ip6":
+		ipv6Conn, err = listenIPv6(dest.Params)
+	default:
+		panic(fmt.Sprintf("unknown protocol: %q", dest.Params.Protocol))
+	}
+	return
+}
+
+func listenRawTCPv4(dest *params.DestinationParams) (*ipv4.PacketConn, error) {
+	conn, err := listenPacket(dest, "ip4:6", dest.Source)
+	if err != nil {
+		return nil, err
+	}
+	return ipv4.NewPacketConn(conn), nil
+}
+
+func listenRawTCPv6(dest *params.DestinationParams) (*ipv6.PacketConn, error) {
+	conn, err := listenPacket(dest, "ip6:6", dest.Source)
+	if err != nil {
+		return nil, err
+	}
+	return ipv6.NewPacketConn(conn), nil
+}
+
+func (app *appState) sendTraceRound(dest *destinationState, addr *net.IPAddr, ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn) error {
+	isIPv4 := addr.IP.To4() != nil
+	var source net.IP
+	if dest.Params.Probe != "icmp" {
+		// The checksums of UDP and TCP cover the source address.
+		var err error
+		source, err = routeSource(dest.Params, addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	dest.mtx.Lock()
+	limit := dest.trace.Limit
+	id := dest.trace.ID
+	port := dest.trace.UDPPort6
+	if isIPv4 {
+		port = dest.trace.UDPPort4
+	}
+	dest.mtx.Unlock()
+
+	for ttl := uint8(1); ttl <= limit && ttl != 0; ttl++ {
+		seq, gen := app.trackHop(dest, addr.IP, ttl)
+		var (
+			packet []byte
+			remote net.Addr = addr
+		)
+		switch dest.Params.Probe {
+		case "icmp":
+			packet = marshalTraceICMP(isIPv4, id, seq)
+		case "tcp":
+			packet = marshalTraceTCP(source, addr.IP, id, dest.Params.Port, seq)
+		case "udp":
+			packet = marshalTraceUDP(source, addr.IP, port, dest.Params.Port, seq, ttl)
+			remote = &net.UDPAddr{IP: addr.IP, Port: int(dest.Params.Port), Zone: addr.Zone}
+		}
+		var err error
+		if isIPv4 {
+			if err = ipv4Conn.SetTTL(int(ttl)); err == nil {
+				_, err = ipv4Conn.WriteTo(packet, nil, remote)
+			}
+		} else {
+			if err = ipv6Conn.SetHopLimit(int(ttl)); err == nil {
+				_, err = ipv6Conn.WriteTo(packet, nil, remote)
+			}
+		}
+		if err != nil {
+			app.untrackHop(dest, seq, gen)
+			return err
+		}
+	}
+	return nil
+}
+
+// Find the source address the kernel would use to reach addr.
+func routeSource(dest *params.DestinationParams, addr *net.IPAddr) (net.IP, error) {
+	if ip := net.ParseIP(dest.Source); ip != nil {
+		return ip, nil
+	}
+	// Connecting a UDP socket sends nothing, but picks a route.
+	conn, err := dialContext(context.Background(), dest, &net.Dialer{}, "udp", (&net.UDPAddr{IP: addr.IP, Port: 9, Zone: addr.Zone}).String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Start waiting for the reply of a trace probe.
+func (app *appState) trackHop(dest *destinationState, addr net.IP, ttl uint8) (seq uint16, gen uint64) {
+	dest.mtx.Lock()
+	seq = dest.trace.NextSeq
+	dest.trace.NextSeq++
+	if dest.Params.Probe == "udp" {
+		// The UDP checksum can be neither 0x0000 (no checksum) nor 0xffff (its alias).
+		for seq == 0x0000 || seq == 0xffff {
+			seq = dest.trace.NextSeq
+			dest.trace.NextSeq++
+		}
+	}
+	dest.trace.NextGen++
+	gen = dest.trace.NextGen
+	dest.trace.Probes[seq] = hopProbe{
+		Addr:     addr,
+		Gen:      gen,
+		SendTime: time.Now(),
+		TTL:      ttl,
+	}
+	dest.mtx.Unlock()
+
+	time.AfterFunc(dest.Params.Timeout, func() {
+		dest.mtx.Lock()
+		probe, ok := dest.trace.Probes[seq]
+		if !ok || probe.Gen != gen {
+			dest.mtx.Unlock()
+			return
+		}
+		delete(dest.trace.Probes, seq)
+		if probe.TTL == dest.trace.Limit && dest.trace.Limit < dest.Params.Trace {
+			// The destination might have moved further away.
+			dest.trace.Limit = dest.Params.Trace
+		}
+		dest.mtx.Unlock()
+		app.printHopLost(dest, probe.TTL)
+	})
+	return
+}
+
+// Stop waiting for a trace probe that failed to be sent.
+func (app *appState) untrackHop(dest *destinationState, seq uint16, gen uint64) {
+	dest.mtx.Lock()
+	if probe, ok := dest.trace.Probes[seq]; ok && probe.Gen == gen {
+		delete(dest.trace.Probes, seq)
+	}
+	dest.mtx.Unlock()
+}
+
+// Stop waiting for a trace probe whose reply has arrived, then print it.
+// Late replies are dropped, since they have already been reported as lost.
+func (app *appState) completeHop(dest *destinationState, reply *hopReply) (matched bool) {
+	dest.mtx.Lock()
+	probe, ok := dest.trace.Probes[reply.Seq]
+	if reply.TTL != 0 && (!ok || probe.TTL != reply.TTL) {
+		ok = false
+		for seq, p := range dest.trace.Probes {
+			if p.TTL == reply.TTL && (!ok || p.SendTime.Before(probe.SendTime)) {
+				reply.Seq, probe, ok = seq, p, true
+			}
+		}
+	}
+	if !ok || (reply.Addr != nil && !probe.Addr.Equal(reply.Addr)) {
+		dest.mtx.Unlock()
+		return false
+	}
+	delete(dest.trace.Probes, reply.Seq)
+	if reply.Reached && probe.TTL > dest.trace.Limit {
+		// The destination has already been reached at a lower hop.
+		dest.mtx.Unlock()
+		return true
+	}
+	if reply.Reached && probe.TTL < dest.trace.Limit {
+		dest.trace.Limit = probe.TTL
+	} else if !reply.Reached && probe.TTL == dest.trace.Limit && dest.trace.Limit < dest.Params.Trace {
+		// The destination has moved further away.
+		dest.trace.Limit = dest.Params.Trace
+	}
+	dest.mtx.Unlock()
+
+	p := &point{Measurement: "ping_hop", Time: app.nextUnixTime(reply.RecvTime)}
+	p.AddDestinationTags(dest.Params)
+	p.AddTag("hop", strconv.Itoa(int(probe.TTL)))
+	p.AddField("reply_from", reply.ReplyFrom.String())
+	p.AddField("reached", reply.Reached)
+	p.AddField("lost", false)
+	p.AddField("rtt", reply.RecvTime.Sub(probe.SendTime))
+	app.writePoint(p)
+	return true
+}
+
+func (app *appState) printHopLost(dest *destinationState, ttl uint8) {
+	p := &point{Measurement: "ping_hop", Time: app.nextUnixTime(time.Now())}
+	p.AddDestinationTags(dest.Params)
+	p.AddTag("hop", strconv.Itoa(int(ttl)))
+	p.AddField("lost", true)
+	app.writePoint(p)
+}
+
+// Match an ICMP error against trace probes by the packet it quotes.
+// Time Exceeded comes from a hop in the middle, while Destination Unreachable from the destination itself means the end of the path.
+func (app *appState) processHopError(isIPv6 bool, src net.Addr, recvTime time.Time, unreachable bool, quoted []byte) {
+	proto, quotedDst, transport, ok := parseQuotedPacket(isIPv6, quoted)
+	if !ok {
+		return
+	}
+	srcIP := addrIP(src)
+	reply := &hopReply{
+		Addr:      quotedDst,
+		RecvTime:  recvTime,
+		ReplyFrom: srcIP,
+		Reached:   unreachable && srcIP.Equal(quotedDst),
+	}
+
+	for i := range app.Destinations {
+		dest := &app.Destinations[i]
+		if dest.Params.Trace == 0 {
+			continue
+		}
+		dest.mtx.Lock()
+		id, udpPort := dest.trace.ID, dest.trace.UDPPort4
+		if isIPv6 {
+			udpPort = dest.trace.UDPPort6
+		}
+		dest.mtx.Unlock()
+
+		srcPort := binary.BigEndian.Uint16(transport[0:2])
+		dstPort := binary.BigEndian.Uint16(transport[2:4])
+		switch {
+		case dest.Params.Probe == "icmp" && !isIPv6 && proto == 1 && transport[0] == byte(ipv4.ICMPTypeEcho),
+			dest.Params.Probe == "icmp" && isIPv6 && proto == 58 && transport[0] == byte(ipv6.ICMPTypeEchoRequest):
+			if binary.BigEndian.Uint16(transport[4:6]) != id {
+				continue
+			}
+			reply.Seq = binary.BigEndian.Uint16(transport[6:8])
+		case dest.Params.Probe == "tcp" && proto == 6:
+			if srcPort != id || dstPort != dest.Params.Port {
+				continue
+			}
+			reply.Seq = uint16(binary.BigEndian.Uint32(transport[4:8]))
+		case dest.Params.Probe == "udp" && proto == 17:
+			if srcPort != udpPort || dstPort != dest.Params.Port {
+				continue
+			}
+			reply.Seq = binary.BigEndian.Uint16(transport[6:8])
+			reply.TTL = uint8(binary.BigEndian.Uint16(transport[4:6]) - udpTraceHeaderLen)
+		default:
+			continue
+		}
+		app.completeHop(dest, reply)
+	}
+}
+
+// Match an ICMP echo reply against ICMP trace probes.
+// Return true if it belongs to a trace, so it is not an echo reply of normal probes.
+func (app *appState) processHopEchoReply(src net.Addr, recvTime time.Time, body *icmp.Echo) (matched bool) {
+	for i := range app.Destinations {
+		dest := &app.Destinations[i]
+		if dest.Params.Trace == 0 || dest.Params.Probe != "icmp" {
+			continue
+		}
+		dest.mtx.Lock()
+		id := dest.trace.ID
+		dest.mtx.Unlock()
+		if uint16(body.ID) != id {
+			continue
+		}
+		if app.completeHop(dest, &hopReply{
+			Addr:      addrIP(src),
+			RecvTime:  recvTime,
+			ReplyFrom: addrIP(src),
+			Reached:   true,
+			Seq:       uint16(body.Seq),
+		}) {
+			matched = true
+		}
+	}
+	return
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// The compensation word keeps the ones' complement sum of the sequence number and itself constant, so is the checksum.
+func marshalTraceICMP(isIPv4 bool, id, seq uint16) []byte {
+	var typ icmp.Type = ipv6.ICMPTypeEchoRequest
+	if isIPv4 {
+		typ = ipv4.ICMPTypeEcho
+	}
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, ^seq)
+	packet, err := (&icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: int(id), Seq: int(seq), Data: data},
+	}).Marshal(nil)
+	if err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+// Length of the UDP header, the sequence number, and the compensation word.
+const udpTraceHeaderLen = 12
+
+// The payload carries the sequence number, then a compensation word that makes the UDP checksum equal to the sequence number.
+// With checksum offloading, the quoted checksum may be incomplete, so the payload is also padded to TTL bytes to tell probes apart.
+func marshalTraceUDP(src, dst net.IP, srcPort, dstPort, seq uint16, ttl uint8) []byte {
+	payload := make([]byte, udpTraceHeaderLen-8+int(ttl))
+	binary.BigEndian.PutUint16(payload[0:2], seq)
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint16(header[0:2], srcPort)
+	binary.BigEndian.PutUint16(header[2:4], dstPort)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(header)+len(payload)))
+	sum := onesSum(pseudoHeader(src, dst, 17, len(header)+len(payload)), header, payload)
+	// checksum = ^(sum + comp), so comp = ^checksum - sum.
+	binary.BigEndian.PutUint16(payload[2:4], onesAdd(^seq, ^sum))
+	// The kernel fills in the checksum.
+	return payload
+}
+
+func marshalTraceTCP(src, dst net.IP, srcPort, dstPort, seq uint16) []byte {
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint16(header[0:2], srcPort)
+	binary.BigEndian.PutUint16(header[2:4], dstPort)
+	binary.BigEndian.PutUint32(header[4:8], uint32(seq))
+	header[12] = 5 << 4 // Data offset
+	header[13] = 0x02   // SYN
+	binary.BigEndian.PutUint16(header[14:16], 65535)
+	binary.BigEndian.PutUint16(header[16:18], ^onesSum(pseudoHeader(src, dst, 6, len(header)), header))
+	return header
+}
+
+func pseudoHeader(src, dst net.IP, proto uint8, length int) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		buf := make([]byte, 12)
+		copy(buf[0:4], src4)
+		copy(buf[4:8], dst4)
+		buf[9] = proto
+		binary.BigEndian.PutUint16(buf[10:12], uint16(length))
+		return buf
+	}
+	buf := make([]byte, 40)
+	copy(buf[0:16], src.To16())
+	copy(buf[16:32], dst.To16())
+	binary.BigEndian.PutUint32(buf[32:36], uint32(length))
+	buf[39] = proto
+	return buf
+}
+
+// Ones' complement sum of 16-bit words, as used by Internet checksums.
+func onesSum(bufs ...[]byte) uint16 {
+	var sum uint32
+	for _, buf := range bufs {
+		for i := 0; i+1 < len(buf); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(buf[i : i+2]))
+		}
+		if len(buf)%2 != 0 {
+			sum += uint32(buf[len(buf)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+func onesAdd(a, b uint16) uint16 {
+	sum := uint32(a) + uint32(b)
+	return uint16(sum&0xffff + sum>>16)
+}
+
+// Raw TCP sockets receive every TCP segment, so look for SYN-ACK or RST replying to our SYN.
+func (app *appState) startTraceTCPReceivers(dest *destinationState, ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn) {
+	if ipv4Conn != nil {
+		go func() {
+			var buf [65536]byte
+			for {
+				n, _, src, err := ipv4Conn.ReadFrom(buf[:])
+				if err != nil {
+					log.Printf("failed to receive TCP segment: %v\n", err)
+					return
+				}
+				app.processHopTCPReply(dest, src, time.Now(), buf[:n])
+			}
+		}()
+	}
+	if ipv6Conn != nil {
+		go func() {
+			var buf [65536]byte
+			for {
+				n, _, src, err := ipv6Conn.ReadFrom(buf[:])
+				if err != nil {
+					log.Printf("failed to receive TCP segment: %v\n", err)
+					return
+				}
+				app.processHopTCPReply(dest, src, time.Now(), buf[:n])
+			}
+		}()
+	}
+}
+
+func (app *appState) processHopTCPReply(dest *destinationState, src net.Addr, recvTime time.Time, segment []byte) {
+	if len(segment) < 20 {
+		return
+	}
+	dest.mtx.Lock()
+	id := dest.trace.ID
+	dest.mtx.Unlock()
+	const flagRST, flagSYN, flagACK = 0x04, 0x02, 0x10
+	flags := segment[13]
+	if binary.BigEndian.Uint16(segment[0:2]) != dest.Params.Port || binary.BigEndian.Uint16(segment[2:4]) != id || flags&flagACK == 0 || flags&(flagSYN|flagRST) == 0 {
+		return
+	}
+	app.completeHop(dest, &hopReply{
+		Addr:      addrIP(src),
+		RecvTime:  recvTime,
+		ReplyFrom: addrIP(src),
+		Reached:   true,
+		Seq:       uint16(binary.BigEndian.Uint32(segment[8:12]) - 1),
+	})
+}
+
+// If the destination runs a UDP echo service, the sequence number comes back in the payload.
+func (app *appState) startTraceUDPReceivers(dest *destinationState, ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn) {
+	if ipv4Conn != nil {
+		go func() {
+			var buf [65536]byte
+			for {
+				n, _, src, err := ipv4Conn.ReadFrom(buf[:])
+				if err != nil {
+					log.Printf("failed to receive UDP message: %v\n", err)
+					return
+				}
+				app.processHopUDPReply(dest, src, time.Now(), buf[:n])
+			}
+		}()
+	}
+	if ipv6Conn != nil {
+		go func() {
+			var buf [65536]byte
+			for {
+				n, _, src, err := ipv6Conn.ReadFrom(buf[:])
+				if err != nil {
+					log.Printf("failed to receive UDP message: %v\n", err)
+					return
+				}
+				app.processHopUDPReply(dest, src, time.Now(), buf[:n])
+			}
+		}()
+	}
+}
+
+func (app *appState) processHopUDPReply(dest *destinationState, src net.Addr, recvTime time.Time, payload []byte) {
+	if udpSrc, ok := src.(*net.UDPAddr); !ok || udpSrc.Port != int(dest.Params.Port) || len(payload) < 2 {
+		return
+	}
+	app.completeHop(dest, &hopReply{
+		Addr:      addrIP(src),
+		RecvTime:  recvTime,
+		ReplyFrom: addrIP(src),
+		Reached:   true,
+		Seq:       binary.BigEndian.Uint16(payload[0:2]),
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A kernel timestamp of a sent packet, read from the socket error queue.
+type txTimestamp struct {
+	// In wall clock time, or zero if not available.
+	HardwareTime time.Time
+	SoftwareTime time.Time
+	// The sent packet, with all headers down to the link layer.
+	Packet []byte
+}
+
+// Ask the kernel to report when requests actually leave, so the time they spend in the send call and the qdisc
+// is not counted as RTT.
+func setTxTimestamps(dest *destinationState, ipv4Conn *ipv4.PacketConn, ipv6Conn *ipv6.PacketConn) error {
+	if !dest.Params.TxTimestamp {
+		return nil
+	}
+	var conns []syscall.Conn
+	if ipv4Conn != nil {
+		conns = append(conns, ipv4Conn.PacketConn.(syscall.Conn))
+	}
+	if ipv6Conn != nil {
+		conns = append(conns, ipv6Conn.PacketConn.(syscall.Conn))
+	}
+	for _, conn := range conns {
+		if err := setTxTimestamp(conn); err != nil {
+			return fmt.Errorf("failed to enable transmit timestamps for destination %s: %w", dest.Params.Destination, err)
+		}
+	}
+	dest.mtx.Lock()
+	dest.txConns = conns
+	dest.mtx.Unlock()
+	return nil
+}
+
+// Read the socket error queues of the send sockets of dest, to record transmit timestamps and report ICMP errors.
+func (app *appState) collectTxTimestamps(dest *destinationState) {
+	dest.mtx.Lock()
+	conns := dest.txConns
+	dest.mtx.Unlock()
+	for _, conn := range conns {
+		if _, icmpErrors, _ := app.drainErrQueue(dest, conn); icmpErrors != 0 {
+			dest.mtx.Lock()
+			dest.drainedErrors += icmpErrors
+			dest.mtx.Unlock()
+		}
+	}
+}
+
+// Record transmit timestamps in the requests still in flight.
+func (app *appState) recordTxTimestamps(dest *destinationState, now time.Time, stamps []txTimestamp) {
+	for i := range stamps {
+		seq, ok := parseTxPacket(dest, stamps[i].Packet)
+		if !ok {
+			continue
+		}
+		txTime, source, ok := kernelTime(now, stamps[i].HardwareTime, stamps[i].SoftwareTime)
+		if !ok {
+			continue
+		}
+		dest.mtx.Lock()
+		if req, ok := dest.inFlight[seq]; ok {
+			req.TxTime = txTime
+			req.TxTimestamp = source
+			dest.inFlight[seq] = req
+		}
+		dest.mtx.Unlock()
+	}
+}
+
+// The looped packet starts with headers of unknown length, but ends with the request we sent,
+// whose length is known.
+func parseTxPacket(dest *destinationState, packet []byte) (seq uint16, ok bool) {
+	var id uint16
+	switch dest.Params.Probe {
+	case "icmp":
+		n := 8 + int(dest.Params.Size)
+		if len(packet) < n {
+			return
+		}
+		request := packet[len(packet)-n:]
+		if request[0] != byte(ipv4.ICMPTypeEcho) && request[0] != byte(ipv6.ICMPTypeEchoRequest) {
+			return
+		}
+		id = binary.BigEndian.Uint16(request[4:6])
+		seq = binary.BigEndian.Uint16(request[6:8])
+	case "udp":
+		n := udpEchoHeaderLen + int(dest.Params.Size)
+		if len(packet) < n {
+			return
+		}
+		body, _ := parseUDPEcho(packet[len(packet)-n:])
+		id, seq = uint16(body.ID), uint16(body.Seq)
+	default:
+		return
+	}
+	return seq, id == dest.ID
+}
+
+// Return when a request actually left, if it is still in flight and its transmit timestamp has been read.
+func (app *appState) requestTxTime(dest *destinationState, seq uint16) (txTime time.Time, source string, ok bool) {
+	app.collectTxTimestamps(dest)
+	dest.mtx.Lock()
+	req, ok := dest.inFlight[seq]
+	dest.mtx.Unlock()
+	if !ok || req.TxTime.IsZero() {
+		return time.Time{}, "", false
+	}
+	return req.TxTime, req.TxTimestamp, true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/m13253/telegraf-better-ping/params"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestParseTxPacket(t *testing.T) {
+	const (
+		id   = 0x1234
+		size = 16
+	)
+	marshalICMP := func(typ icmp.Type, id, seq int) []byte {
+		packet, err := (&icmp.Message{Type: typ, Body: &icmp.Echo{ID: id, Seq: seq, Data: make([]byte, size)}}).Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packet
+	}
+	// The looped packet may start with an IP header, or nothing at all, depending on the socket.
+	ipHeader := make([]byte, 20)
+	tests := []struct {
+		name   string
+		probe  string
+		packet []byte
+		seq    uint16
+		ok     bool
+	}{
+		{"icmp", "icmp", marshalICMP(ipv4.ICMPTypeEcho, id, 7), 7, true},
+		{"icmp with IP header", "icmp", append(ipHeader, marshalICMP(ipv4.ICMPTypeEcho, id, 8)...), 8, true},
+		{"icmpv6", "icmp", marshalICMP(ipv6.ICMPTypeEchoRequest, id, 9), 9, true},
+		{"icmp other identifier", "icmp", marshalICMP(ipv4.ICMPTypeEcho, id+1, 7), 7, false},
+		{"icmp reply", "icmp", marshalICMP(ipv4.ICMPTypeEchoReply, id, 7), 0, false},
+		{"icmp too short", "icmp", marshalICMP(ipv4.ICMPTypeEcho, id, 7)[:8+size-1], 0, false},
+		{"udp", "udp", marshalUDPEcho(&icmp.Echo{ID: id, Seq: 65535, Data: make([]byte, size)}), 65535, true},
+		{"udp with headers", "udp", append(make([]byte, 28), marshalUDPEcho(&icmp.Echo{ID: id, Seq: 3, Data: make([]byte, size)})...), 3, true},
+		{"udp other identifier", "udp", marshalUDPEcho(&icmp.Echo{ID: id - 1, Seq: 3, Data: make([]byte, size)}), 3, false},
+		{"udp too short", "udp", make([]byte, udpEchoHeaderLen+size-1), 0, false},
+		{"stamp", "stamp", make([]byte, 44), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := &destinationState{
+				Params: &params.DestinationParams{Probe: tt.probe, Size: size},
+				ID:     id,
+			}
+			seq, ok := parseTxPacket(dest, tt.packet)
+			if ok != tt.ok || (ok && seq != tt.seq) {
+				t.Errorf("parseTxPacket() = %d, %v, want %d, %v", seq, ok, tt.seq, tt.ok)
+			}
+		})
+	}
+}